@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "net"
+
+const listenBacklogSupported = false
+
+func setListenBacklog(ln net.Listener, n int) error {
+	return nil
+}
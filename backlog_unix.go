@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const listenBacklogSupported = true
+
+// setListenBacklog asks for an accept queue of n connections on ln. A
+// net.ListenConfig Control function runs before listen(2), with Go's own
+// backlog still to come, so instead listen(2) is called again on the
+// listening socket, which these systems take as a change of backlog. The
+// kernel caps it at somaxconn (kern.ipc.somaxconn on the BSDs).
+func setListenBacklog(ln net.Listener, n int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return errors.New("listener has no socket")
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.Listen(int(fd), n)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of a -config file. Each key is named after the
+// flag it sets, and durations are written as for the flag, e.g. "30s".
+// Flags given on the command line take precedence over the file.
+type Config struct {
+	Debug               *bool    `yaml:"debug"`
+	Backend             []string `yaml:"backend"`
+	BackendScheme       *string  `yaml:"backend-scheme"`
+	BackendHost         *string  `yaml:"backend-host"`
+	BackendPort         *string  `yaml:"backend-port"`
+	BackendPath         *string  `yaml:"backend-path"`
+	Listen              *string  `yaml:"listen"`
+	Target              *string  `yaml:"target"`
+	ProxyProtocol       *string  `yaml:"proxy-protocol"`
+	NoProxyHeader       *bool    `yaml:"no-proxy-header"`
+	ProxyLocalIP        *string  `yaml:"proxy-local-ip"`
+	ProxyTargetPort     *int     `yaml:"proxy-target-port"`
+	ConnectHeader       []string `yaml:"connect-header"`
+	ForwardedHeader     *string  `yaml:"forwarded-header"`
+	AcceptProxyProtocol *bool    `yaml:"accept-proxy-protocol"`
+	RequireProxyHeader  *bool    `yaml:"require-proxy-protocol"`
+	DrainTimeout        *string  `yaml:"drain-timeout"`
+	MetricsAddr         *string  `yaml:"metrics-addr"`
+	HealthAddr          *string  `yaml:"health-addr"`
+	DialSourceIP        *string  `yaml:"dial-source-ip"`
+	DialTimeout         *string  `yaml:"dial-timeout"`
+	ReadIdleTimeout     *string  `yaml:"read-idle-timeout"`
+	PingTimeout         *string  `yaml:"ping-timeout"`
+	Trace               *bool    `yaml:"trace"`
+	MaxStreamsPerConn   *int     `yaml:"max-streams-per-conn"`
+	MaxIdleConns        *int     `yaml:"max-idle-conns"`
+	IdleConnTimeout     *string  `yaml:"idle-conn-timeout"`
+	StrictMaxStreams    *bool    `yaml:"strict-max-streams"`
+	RetryRefused        *bool    `yaml:"retry-refused-streams"`
+	RetryGoAway         *bool    `yaml:"retry-goaway"`
+	MaxHeaderBytes      *int     `yaml:"max-header-bytes"`
+	Prewarm             *bool    `yaml:"prewarm"`
+	PrewarmRequired     *bool    `yaml:"prewarm-required"`
+	KeyLog              *string  `yaml:"keylog"`
+	SNIFromTarget       *bool    `yaml:"backend-sni-from-target"`
+	Quiet               *bool    `yaml:"quiet"`
+	StatsInterval       *string  `yaml:"stats-interval"`
+	LogFile             *string  `yaml:"log-file"`
+	LogMaxSize          *int     `yaml:"log-max-size"`
+	LogMaxBackups       *int     `yaml:"log-max-backups"`
+	ClientCert          *string  `yaml:"client-cert"`
+	ClientKey           *string  `yaml:"client-key"`
+	CACert              *string  `yaml:"cacert"`
+	Insecure            *bool    `yaml:"insecure"`
+	SNI                 *string  `yaml:"sni"`
+	MinTLS              *string  `yaml:"min-tls"`
+	LogFormat           *string  `yaml:"log-format"`
+	BufferSize          *int     `yaml:"buffer-size"`
+	MaxConnections      *int     `yaml:"max-connections"`
+	ConnectRetries      *int     `yaml:"connect-retries"`
+	ConnectRetryDelay   *string  `yaml:"connect-retry-delay"`
+	ConnectTimeout      *string  `yaml:"connect-timeout"`
+	BackendFallback     *bool    `yaml:"backend-fallback"`
+	IdleTimeout         *string  `yaml:"idle-timeout"`
+	MaxConnLifetime     *string  `yaml:"max-conn-lifetime"`
+	HealthInterval      *string  `yaml:"health-interval"`
+	HealthMaxInterval   *string  `yaml:"health-max-interval"`
+	Plaintext           *bool    `yaml:"plaintext"`
+	ProxyUser           *string  `yaml:"proxy-user"`
+	ProxyPass           *string  `yaml:"proxy-pass"`
+	ProxyAuthHeader     *string  `yaml:"proxy-auth-header"`
+	BearerToken         *string  `yaml:"bearer-token"`
+	BearerTokenFile     *string  `yaml:"bearer-token-file"`
+	Protocol            *string  `yaml:"protocol"`
+	OnOverflow          *string  `yaml:"on-overflow"`
+	Verbose             *bool    `yaml:"verbose"`
+	AllowCIDR           []string `yaml:"allow-cidr"`
+	TargetMap           []string `yaml:"target-map"`
+	TargetTLS           *bool    `yaml:"target-tls"`
+	TargetTLSCA         *string  `yaml:"target-tls-ca"`
+	TargetTLSServerName *string  `yaml:"target-tls-server-name"`
+	LoopbackOnly        *bool    `yaml:"reject-non-loopback-target"`
+	TargetFromSNI       []string `yaml:"target-from-sni"`
+	RejectUnknownSNI    *bool    `yaml:"reject-unknown-sni"`
+	DenyCIDR            []string `yaml:"deny-cidr"`
+	ConnRate            *float64 `yaml:"conn-rate"`
+	ConnBurst           *int     `yaml:"conn-burst"`
+	ReusePort           *bool    `yaml:"reuse-port"`
+	ListenBacklog       *int     `yaml:"listen-backlog"`
+	PprofAddr           *string  `yaml:"pprof-addr"`
+	TLSSessionCacheSize *int     `yaml:"tls-session-cache-size"`
+	SOCKS5              *bool    `yaml:"socks5"`
+	HTTPConnect         *bool    `yaml:"http-connect"`
+	ListenCert          *string  `yaml:"listen-cert"`
+	ListenKey           *string  `yaml:"listen-key"`
+	ListenClientCA      *string  `yaml:"listen-client-ca"`
+	AdminAddr           *string  `yaml:"admin-addr"`
+	DebugAddr           *string  `yaml:"debug-addr"`
+	TCPKeepAlive        *string  `yaml:"tcp-keepalive"`
+	TCPNoDelay          *bool    `yaml:"tcp-nodelay"`
+	WriteTimeout        *string  `yaml:"write-timeout"`
+	DNSResolver         *string  `yaml:"dns-resolver"`
+	DNSProtocol         *string  `yaml:"dns-protocol"`
+	CloseMode           *string  `yaml:"close-mode"`
+}
+
+// loadConfig reads and validates the YAML file at path. Unknown keys are
+// an error so that typos do not go unnoticed.
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Config
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// validate checks what the flags themselves cannot. Settings are merged
+// with the command line through the flags, so conflicting or missing
+// options are caught by the same checks in main either way.
+func (c *Config) validate() error {
+	for _, backend := range c.Backend {
+		if strings.TrimSpace(backend) == "" {
+			return errors.New("empty backend")
+		}
+	}
+	return nil
+}
+
+// apply sets each flag named in the file through fs, skipping those in
+// set, which were given on the command line or in the environment, and
+// adds the ones it sets to set.
+func (c *Config) apply(fs *flag.FlagSet, set map[string]bool) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		field := v.Field(i)
+		if set[name] || field.IsNil() {
+			continue
+		}
+		var values []string
+		if field.Kind() == reflect.Slice {
+			for j := 0; j < field.Len(); j++ {
+				values = append(values, fmt.Sprint(field.Index(j).Interface()))
+			}
+		} else {
+			values = append(values, fmt.Sprint(field.Elem().Interface()))
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		set[name] = true
+	}
+	return nil
+}
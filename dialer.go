@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mhoran/mysql-http2-proxy/proxy"
+)
+
+// backendDialer connects to backends for the transports, giving up on the
+// TCP connect and the TLS handshake together after timeout or once the
+// dial's context is done.
+type backendDialer struct {
+	dialer    net.Dialer
+	timeout   time.Duration
+	noDelay   bool
+	plaintext bool
+	// files, if set, supplies the CA bundle to verify backends with, which
+	// can be swapped on SIGHUP.
+	files         *tlsFiles
+	sniFromTarget bool
+	quiet         bool
+	debugLog      *log.Logger
+	// wrap, if set, wraps each connection once it is established.
+	wrap func(conn net.Conn, addr string) net.Conn
+}
+
+// dialContext has the signature of http2.Transport.DialTLSContext. A nil
+// cfg dials without TLS.
+func (d *backendDialer) dialContext(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	if !d.quiet {
+		log.Printf("Connecting to %s\n", addr)
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(d.noDelay)
+	}
+	if d.plaintext || cfg == nil {
+		return d.wrapConn(conn, addr), nil
+	}
+
+	// The transports pass a copy of tlsConfig today, but clone it again
+	// so that the overrides below can never leak into a shared config.
+	cfg = cfg.Clone()
+	if d.files != nil {
+		cfg.RootCAs = d.files.rootCAs()
+	}
+	if target, ok := proxy.TargetFromContext(ctx); ok && d.sniFromTarget {
+		cfg.ServerName, _, _ = net.SplitHostPort(target)
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if d.debugLog != nil {
+		if tlsConn.ConnectionState().DidResume {
+			d.debugLog.Printf("Resumed TLS session with %s", addr)
+		} else {
+			d.debugLog.Printf("Full TLS handshake with %s", addr)
+		}
+	}
+	return d.wrapConn(tlsConn, addr), nil
+}
+
+func (d *backendDialer) wrapConn(conn net.Conn, addr string) net.Conn {
+	if d.wrap == nil {
+		return conn
+	}
+	return d.wrap(conn, addr)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDialContextStalledHandshake dials a listener that accepts but never
+// answers the TLS handshake, and checks that cancelling the dial or its
+// timeout aborts the handshake.
+func TestDialContextStalledHandshake(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		cancelAfter time.Duration
+		want        error
+	}{
+		{name: "cancelled", cancelAfter: 100 * time.Millisecond, want: context.Canceled},
+		{name: "dial timeout", timeout: 100 * time.Millisecond, want: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			closed := make(chan struct{})
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				// Swallow the ClientHello and wait for the dialer to give up,
+				// or for long enough to fail the test if it doesn't.
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						close(closed)
+						return
+					}
+				}
+			}()
+
+			ctx := context.Background()
+			if tt.cancelAfter > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer cancel()
+				time.AfterFunc(tt.cancelAfter, cancel)
+			}
+			d := &backendDialer{timeout: tt.timeout, quiet: true}
+			start := time.Now()
+			conn, err := d.dialContext(ctx, "tcp", ln.Addr().String(), &tls.Config{})
+			if err == nil {
+				conn.Close()
+				t.Fatal("handshake with a silent server succeeded")
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("dial took %v to give up", d)
+			}
+			select {
+			case <-closed:
+			case <-time.After(2 * time.Second):
+				t.Error("connection to the server was left open")
+			}
+		})
+	}
+}
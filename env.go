@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envPrefix = "PROXY_"
+
+// envName returns the environment variable for a flag, e.g. PROXY_BACKEND
+// for -backend and PROXY_DIAL_TIMEOUT for -dial-timeout.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag of fs that is not in set from its environment
+// variable, if there is one, and adds it to set.
+func applyEnv(fs *flag.FlagSet, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), serr)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+// copySet returns a copy of set, to keep the flags set so far while more
+// are added to set.
+func copySet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for name := range set {
+		c[name] = true
+	}
+	return c
+}
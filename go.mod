@@ -1,7 +1,12 @@
 module github.com/mhoran/mysql-http2-proxy
 
-go 1.17
+go 1.18
 
-require golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4
+require (
+	golang.org/x/net v0.7.0
+	golang.org/x/sys v0.5.0
+	golang.org/x/time v0.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require golang.org/x/text v0.3.6 // indirect
+require golang.org/x/text v0.7.0 // indirect
@@ -1,191 +1,1127 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/mhoran/mysql-http2-proxy/proxy"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/http2"
 )
 
-var debugLog *log.Logger
-
-func WrapConnection(c net.Conn) net.Conn {
-	return &spyConnection{
-		Conn: c,
+// openKeyLog opens the TLS key log at path for appending, so that the
+// keys of earlier runs are kept. Writes from concurrent handshakes are
+// serialized.
+func openKeyLog(path string) (io.Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
 	}
+	return &lockedWriter{w: f}, nil
 }
 
-type spyConnection struct {
-	net.Conn
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
 }
 
-func (sc *spyConnection) Read(b []byte) (int, error) {
-	n, err := sc.Conn.Read(b)
-	if err != nil {
-		return n, err
-	}
-	debugLog.Printf("Read %d bytes from proxy", n)
-	return n, nil
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
 
-func (sc *spyConnection) Write(b []byte) (int, error) {
-	n := len(b)
-	debugLog.Printf("Wrote %d bytes to proxy", n)
-	return sc.Conn.Write(b)
-}
+func main() {
+	var debug bool
+	flag.BoolVar(&debug, "debug", false, "enable debug logging")
+	var backends backendList
+	flag.Var(&backends, "backend", "URL to Envoy proxy; comma-separated or repeated for round-robin across several (required)")
+	var backendScheme, backendHost, backendPort, backendPath string
+	flag.StringVar(&backendScheme, "backend-scheme", "https", "scheme of the backend given with -backend-host")
+	flag.StringVar(&backendHost, "backend-host", "", "host of the backend, as an alternative to -backend")
+	flag.StringVar(&backendPort, "backend-port", "", "port of the backend given with -backend-host (default: the scheme's)")
+	flag.StringVar(&backendPath, "backend-path", "", "path of the backend given with -backend-host")
+	var port string
+	flag.StringVar(&port, "port", "3306", "port to listen on (deprecated, use -listen)")
+	var bind string
+	flag.StringVar(&bind, "bind", "127.0.0.1", "host to listen on with -port (deprecated, use -listen)")
+	var listen string
+	flag.StringVar(&listen, "listen", "127.0.0.1:3306", "host:port to listen on, or unix:/path for a Unix domain socket")
+	var target string
+	flag.StringVar(&target, "target", "127.0.0.1:3306", "host:port of the service to tunnel to")
+	var targetMap targetMap
+	flag.Var(&targetMap, "target-map", "tunnel clients in a CIDR range to another target, as cidr=host:port; comma-separated or repeated, first match wins (default: -target)")
+	var loopbackOnly bool
+	flag.BoolVar(&loopbackOnly, "reject-non-loopback-target", false, "refuse to start unless every target resolves only to loopback addresses")
+	var targetTLS bool
+	flag.BoolVar(&targetTLS, "target-tls", false, "wrap each tunnel in a TLS session of its own with the target, inside the CONNECT stream")
+	var targetTLSCA string
+	flag.StringVar(&targetTLSCA, "target-tls-ca", "", "PEM CA bundle to verify targets with under -target-tls (default: system roots)")
+	var targetTLSServerName string
+	flag.StringVar(&targetTLSServerName, "target-tls-server-name", "", "server name to send and verify under -target-tls (default: the target's host)")
+	var sniTargets sniMap
+	flag.Var(&sniTargets, "target-from-sni", "tunnel TLS clients to a target by the server name they ask for, as name=host:port; comma-separated or repeated (requires -listen-cert)")
+	var rejectUnknownSNI bool
+	flag.BoolVar(&rejectUnknownSNI, "reject-unknown-sni", false, "with -target-from-sni, close connections whose server name has no target instead of using the default")
+	var proxyProtocol string
+	flag.StringVar(&proxyProtocol, "proxy-protocol", "none", "PROXY protocol header to send: v1, v2 or none")
+	var noProxyHeader bool
+	flag.BoolVar(&noProxyHeader, "no-proxy-header", false, "never send a PROXY protocol header")
+	var proxyLocalIP string
+	flag.StringVar(&proxyLocalIP, "proxy-local-ip", "", "IP address to advertise as the proxy's own in the PROXY header (default: the address used to reach the backend)")
+	var proxyTargetPort int
+	flag.IntVar(&proxyTargetPort, "proxy-target-port", 0, "destination port to give in the PROXY header (default: the port of -target)")
+	var connectHeaders headerFlag
+	flag.Var(&connectHeaders, "connect-header", "extra header to send with every CONNECT request, as \"Name: Value\"; repeatable")
+	var forwardedHeader string
+	flag.StringVar(&forwardedHeader, "forwarded-header", "", "send the client's address on the CONNECT request in this header: X-Forwarded-For or Forwarded")
+	var acceptProxyProtocol bool
+	flag.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "accept a PROXY protocol header from clients and pass on the address it names; clients without one are passed on with their own address, after up to 200ms if they wait for the server to speak first")
+	var requireProxyProtocol bool
+	flag.BoolVar(&requireProxyProtocol, "require-proxy-protocol", false, "with -accept-proxy-protocol, reject clients that do not send a PROXY header within 5s")
+	var drainTimeout time.Duration
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "how long to wait for connections to finish on shutdown")
+	var metricsAddr string
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve Prometheus metrics on (disabled if empty)")
+	var healthAddr string
+	flag.StringVar(&healthAddr, "health-addr", "", "address to serve /healthz on (disabled if empty)")
+	var dialSourceIP string
+	flag.StringVar(&dialSourceIP, "dial-source-ip", "", "local IP address to connect to backends from (default: chosen by the OS)")
+	var dialTimeout time.Duration
+	flag.DurationVar(&dialTimeout, "dial-timeout", 5*time.Second, "timeout for the backend TCP connect and TLS handshake (0 for none)")
+	var readIdleTimeout time.Duration
+	flag.DurationVar(&readIdleTimeout, "read-idle-timeout", 60*time.Second, "send an HTTP/2 ping after this long without frames from the backend (0 disables)")
+	var pingTimeout time.Duration
+	flag.DurationVar(&pingTimeout, "ping-timeout", 15*time.Second, "close the backend connection if a ping is not acknowledged within this time")
+	var maxIdleConns int
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 0, "most HTTP/2 connections with no tunnels to keep open per backend (0 for no limit)")
+	var idleConnTimeout time.Duration
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", 0, "keep an HTTP/2 connection to each backend ready, redialing it if the backend closes it, for this long after the last tunnel; then close idle connections (0 keeps them until the backend closes them)")
+	var maxStreamsPerConn int
+	flag.IntVar(&maxStreamsPerConn, "max-streams-per-conn", 0, "open another HTTP/2 connection to a backend once each has this many tunnels (0 to rely on the backend's MAX_CONCURRENT_STREAMS)")
+	var strictMaxStreams bool
+	flag.BoolVar(&strictMaxStreams, "strict-max-streams", false, "queue tunnels on existing HTTP/2 connections when the backend's MAX_CONCURRENT_STREAMS is reached, instead of dialing more")
+	var keyLogFile string
+	flag.StringVar(&keyLogFile, "keylog", os.Getenv("SSLKEYLOGFILE"), "append backend TLS keys to this file in NSS key log format, for debugging with Wireshark (default: $SSLKEYLOGFILE)")
+	var statsInterval time.Duration
+	flag.DurationVar(&statsInterval, "stats-interval", 0, "log active connections, bytes transferred and the connection rate this often (0 disables)")
+	var quiet bool
+	flag.BoolVar(&quiet, "quiet", false, "do not log each client connecting, disconnecting and each backend dial; errors are still logged")
+	var logFilePath string
+	flag.StringVar(&logFilePath, "log-file", "", "write logs to this file instead of stderr; reopened on SIGHUP")
+	var logMaxSize int
+	flag.IntVar(&logMaxSize, "log-max-size", 0, "rotate -log-file once it reaches this many megabytes (0 to never rotate)")
+	var logMaxBackups int
+	flag.IntVar(&logMaxBackups, "log-max-backups", 3, "number of rotated -log-file backups to keep")
+	var prewarm bool
+	flag.BoolVar(&prewarm, "prewarm", false, "once listening, probe each backend so the first client does not wait for the TLS and HTTP/2 handshakes")
+	var prewarmRequired bool
+	flag.BoolVar(&prewarmRequired, "prewarm-required", false, "like -prewarm, but exit if any backend fails the probe")
+	var maxHeaderBytes int
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", 0, "largest CONNECT response header block to accept from a backend (0 for the library default, 10MB for h2 and unlimited for h1)")
+	var retryGoAway bool
+	flag.BoolVar(&retryGoAway, "retry-goaway", false, "retry a CONNECT once, on a fresh connection, when the backend sends GOAWAY before the tunnel is established")
+	var retryRefused bool
+	flag.BoolVar(&retryRefused, "retry-refused-streams", false, "retry a CONNECT once, on a connection with room, when the backend refuses the stream before any client bytes were sent")
+	var clientCert string
+	flag.StringVar(&clientCert, "client-cert", "", "PEM client certificate to present to the backend")
+	var clientKey string
+	flag.StringVar(&clientKey, "client-key", "", "PEM private key for -client-cert")
+	var caCert string
+	flag.StringVar(&caCert, "cacert", "", "PEM CA bundle to verify the backend with instead of the system roots")
+	var sniFromTarget bool
+	flag.BoolVar(&sniFromTarget, "backend-sni-from-target", false, "send each tunnel's target host as the TLS server name to the backend, with a separate backend connection per target")
+	var insecure bool
+	flag.BoolVar(&insecure, "insecure", false, "skip verification of the backend certificate")
+	var sni string
+	flag.StringVar(&sni, "sni", "", "TLS server name to send to and verify against the backend (defaults to the -backend host)")
+	var minTLS string
+	flag.StringVar(&minTLS, "min-tls", "1.2", "minimum TLS version for the backend connection: 1.2 or 1.3")
+	var logFormat string
+	flag.StringVar(&logFormat, "log-format", "text", "log output format: text or json")
+	var bufferSize int
+	flag.IntVar(&bufferSize, "buffer-size", proxy.DefaultBufferSize, "size in bytes of the copy buffer used for each direction")
+	var maxConnections int
+	flag.IntVar(&maxConnections, "max-connections", 0, "maximum number of concurrent client connections (0 for unlimited)")
+	var connectRetries int
+	flag.IntVar(&connectRetries, "connect-retries", 0, "number of times to retry a failed CONNECT before dropping the client")
+	var connectTimeout time.Duration
+	flag.DurationVar(&connectTimeout, "connect-timeout", 0, "timeout for each CONNECT request to get its response, including any dial (0 for none)")
+	var connectRetryDelay time.Duration
+	flag.DurationVar(&connectRetryDelay, "connect-retry-delay", 100*time.Millisecond, "delay before the first CONNECT retry, doubled on each further retry")
+	var backendFallback bool
+	flag.BoolVar(&backendFallback, "backend-fallback", false, "try the other backends when the chosen one cannot be reached")
+	var idleTimeout time.Duration
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "close tunnels with no traffic in either direction for this long (0 disables)")
+	var maxConnLifetime time.Duration
+	flag.DurationVar(&maxConnLifetime, "max-conn-lifetime", 0, "force-close tunnels after they have been open this long (0 for unlimited)")
+	var healthInterval time.Duration
+	flag.DurationVar(&healthInterval, "health-interval", 0, "how often to probe each backend and skip unhealthy ones (0 disables)")
+	var healthMaxInterval time.Duration
+	flag.DurationVar(&healthMaxInterval, "health-max-interval", time.Minute, "longest wait between probes of an unhealthy backend, doubling from -health-interval after each failure")
+	var plaintext bool
+	flag.BoolVar(&plaintext, "plaintext", false, "connect to the backend without TLS (cleartext HTTP/2, h2c); implied by http:// backend URLs")
+	var proxyUser string
+	flag.StringVar(&proxyUser, "proxy-user", "", "username for Basic Proxy-Authorization on the CONNECT request")
+	var proxyPass string
+	flag.StringVar(&proxyPass, "proxy-pass", "", "password for -proxy-user")
+	var proxyAuthHeader string
+	flag.StringVar(&proxyAuthHeader, "proxy-auth-header", "", "raw Proxy-Authorization value to send, for schemes other than Basic")
+	var bearerToken string
+	flag.StringVar(&bearerToken, "bearer-token", "", "token to send as Authorization: Bearer on the CONNECT request")
+	var bearerTokenFile string
+	flag.StringVar(&bearerTokenFile, "bearer-token-file", "", "file to read the bearer token from; re-read periodically")
+	var protocol string
+	flag.StringVar(&protocol, "protocol", "h2", "protocol for the CONNECT to the backend: h2, or h1 for HTTP/1.1 CONNECT proxies")
+	var onOverflow string
+	flag.StringVar(&onOverflow, "on-overflow", "wait", "what to do with new connections once -max-connections is reached: wait or reject")
+	var verbose bool
+	flag.BoolVar(&verbose, "verbose", false, "log a summary line for every connection when it closes")
+	var allowCIDRs cidrList
+	flag.Var(&allowCIDRs, "allow-cidr", "only accept clients from this CIDR range; comma-separated or repeated (default: allow all)")
+	var denyCIDRs cidrList
+	flag.Var(&denyCIDRs, "deny-cidr", "reject clients from this CIDR range, even if -allow-cidr matches; comma-separated or repeated")
+	var connRate float64
+	flag.Float64Var(&connRate, "conn-rate", 0, "new connections per second allowed from each source IP (0 for unlimited)")
+	var connBurst int
+	flag.IntVar(&connBurst, "conn-burst", 10, "connections a source IP may open at once before -conn-rate applies")
+	var reusePort bool
+	flag.BoolVar(&reusePort, "reuse-port", false, "set SO_REUSEPORT on the listener so several instances can share the port (ignored where unsupported)")
+	var listenBacklog int
+	flag.IntVar(&listenBacklog, "listen-backlog", 0, "accept queue length to ask for on the listener, a hint capped by the OS somaxconn (0 for the system default; ignored where unsupported)")
+	var socks5 bool
+	flag.BoolVar(&socks5, "socks5", false, "accept SOCKS5 clients and tunnel to the destination each one asks for instead of -target")
+	var httpConnect bool
+	flag.BoolVar(&httpConnect, "http-connect", false, "accept HTTP CONNECT requests from clients, as a forward proxy, and tunnel to the authority each one asks for instead of -target")
+	var listenCert string
+	flag.StringVar(&listenCert, "listen-cert", "", "PEM certificate to serve TLS to clients with (requires -listen-key)")
+	var listenKey string
+	flag.StringVar(&listenKey, "listen-key", "", "PEM private key for -listen-cert")
+	var listenClientCA string
+	flag.StringVar(&listenClientCA, "listen-client-ca", "", "PEM CA bundle; when set, clients must present a certificate signed by it")
+	var adminAddr string
+	flag.StringVar(&adminAddr, "admin-addr", "", "address to serve POST /drain and /undrain on, to fail /healthz without closing tunnels (disabled if empty)")
+	var debugAddr string
+	flag.StringVar(&debugAddr, "debug-addr", "", "address to serve the state of active connections on, at /connections (disabled if empty)")
+	var tcpKeepAlive time.Duration
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", 15*time.Second, "TCP keepalive period for client and backend connections (0 to disable); keepalives do not count as traffic for -idle-timeout")
+	var dnsResolver string
+	flag.StringVar(&dnsResolver, "dns-resolver", "", "host:port of a DNS server to resolve backend hostnames with (default: the system resolver)")
+	var dnsProtocol string
+	flag.StringVar(&dnsProtocol, "dns-protocol", "udp", "transport for -dns-resolver: udp or tcp")
+	var tcpNoDelay bool
+	flag.BoolVar(&tcpNoDelay, "tcp-nodelay", true, "set TCP_NODELAY on client and backend connections, disabling Nagle's algorithm")
+	var closeMode string
+	flag.StringVar(&closeMode, "close-mode", "reset", "how tunnels torn down by errors, timeouts or shutdown are closed: reset (RST) or graceful (FIN)")
+	var writeTimeout time.Duration
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "close tunnels whose client has not accepted data for this long (0 for unlimited)")
+	var trace bool
+	flag.BoolVar(&trace, "trace", false, "log HTTP/2 control frames (SETTINGS, PING, WINDOW_UPDATE, RST_STREAM, GOAWAY) exchanged with backends")
+	var pprofAddr string
+	flag.StringVar(&pprofAddr, "pprof-addr", "", "address to serve /debug/pprof/ on (disabled if empty; do not expose publicly)")
+	var tlsSessionCacheSize int
+	flag.IntVar(&tlsSessionCacheSize, "tls-session-cache-size", 64, "number of backend TLS sessions to cache for resumption (0 to disable)")
+	var showVersion bool
+	flag.BoolVar(&showVersion, "version", false, "print the version and exit")
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "YAML file to read settings from; keys are flag names, and flags given on the command line override them")
+	flag.Parse()
 
-type WriteCounter struct {
-	Message string
-}
+	if showVersion {
+		fmt.Println(versionString())
+		return
+	}
 
-func (wc *WriteCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	debugLog.Printf(wc.Message, n)
-	return n, nil
-}
+	// Flags on the command line win over the environment, which wins over
+	// the -config file. sources holds the flags set so far after each of
+	// them in turn, for settings that can be given in more than one way.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	sources := []map[string]bool{copySet(set)}
+	if err := applyEnv(flag.CommandLine, set); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+	sources = append(sources, copySet(set))
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+		if err := cfg.apply(flag.CommandLine, set); err != nil {
+			log.Fatalf("Invalid -config %s: %v", configFile, err)
+		}
+	}
+	sources = append(sources, set)
+	// given returns the index in sources of the first to set any of names,
+	// or len(sources) if none did.
+	given := func(names ...string) int {
+		for i, src := range sources {
+			for _, name := range names {
+				if src[name] {
+					return i
+				}
+			}
+		}
+		return len(sources)
+	}
+
+	// The backend is named either by -backend or by -backend-host and its
+	// companions; if both are given, the source with precedence wins.
+	byURL := given("backend")
+	byHost := given("backend-host", "backend-scheme", "backend-port", "backend-path")
+	switch {
+	case byURL == byHost && byURL < len(sources):
+		log.Fatal("-backend cannot be combined with -backend-host")
+	case byURL < byHost && byHost < len(sources):
+		log.Printf("-backend given; ignoring -backend-host, -backend-scheme, -backend-port and -backend-path")
+	case byHost < byURL:
+		if backendHost == "" {
+			log.Fatal("-backend-scheme, -backend-port and -backend-path require -backend-host")
+		}
+		if byURL < len(sources) {
+			log.Printf("-backend-host given; ignoring -backend")
+		}
+		host := backendHost
+		if backendPort != "" {
+			if _, err := strconv.ParseUint(backendPort, 10, 16); err != nil {
+				log.Fatalf("Invalid -backend-port %q", backendPort)
+			}
+			host = net.JoinHostPort(backendHost, backendPort)
+		}
+		u := url.URL{Scheme: backendScheme, Host: host, Path: backendPath}
+		if backendPath != "" && !strings.HasPrefix(backendPath, "/") {
+			u.Path = "/" + backendPath
+		}
+		backends = backendList{u.String()}
+	}
 
-func copyProxy(url *url.URL, tr *http2.Transport, conn net.Conn, pr io.ReadCloser, done, doneError chan bool) {
-	req := &http.Request{
-		Method: "CONNECT",
-		URL:    url,
-		Host:   "127.0.0.1:3306",
-		Body:   pr,
+	if len(backends) == 0 {
+		fmt.Println("-backend or -backend-host flag (or backend in -config) is required")
+		os.Exit(1)
 	}
 
-	// Send the request
-	//res, err := c.Do(req)
-	res, err := tr.RoundTrip(req)
+	target, err := parseTarget(target)
 	if err != nil {
-		log.Printf("Error in tr.RoundTrip: %v", err)
-		doneError <- true
-		return
+		log.Fatalf("Invalid -target: %v", err)
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		doneError <- true
-		return
+	header, err := proxy.HeaderBuilderFor(proxyProtocol)
+	if err != nil {
+		log.Fatalf("Invalid -proxy-protocol: %v", err)
+	}
+	if noProxyHeader {
+		if header != nil {
+			log.Printf("-no-proxy-header given; ignoring -proxy-protocol %s", proxyProtocol)
+		}
+		header = nil
+	}
+
+	if proxyTargetPort < 0 || proxyTargetPort > 65535 {
+		log.Fatalf("Invalid -proxy-target-port %d", proxyTargetPort)
+	}
+	var localIP net.IP
+	if proxyLocalIP != "" {
+		if localIP = net.ParseIP(proxyLocalIP); localIP == nil {
+			log.Fatalf("Invalid -proxy-local-ip %q", proxyLocalIP)
+		}
+	}
+
+	var targetTLSConfig *tls.Config
+	if targetTLS {
+		// The target reads a PROXY header before its TLS handshake, but
+		// here the handshake comes first.
+		if header != nil {
+			log.Fatal("-target-tls cannot be combined with -proxy-protocol")
+		}
+		var err error
+		if targetTLSConfig, err = targetTLSConfigFor(targetTLSCA, targetTLSServerName); err != nil {
+			log.Fatal(err)
+		}
+	} else if targetTLSCA != "" || targetTLSServerName != "" {
+		log.Fatal("-target-tls-ca and -target-tls-server-name require -target-tls")
+	}
+
+	var sourceAddr *net.TCPAddr
+	if dialSourceIP != "" {
+		ip := net.ParseIP(dialSourceIP)
+		if ip == nil {
+			log.Fatalf("Invalid -dial-source-ip %q", dialSourceIP)
+		}
+		sourceAddr = &net.TCPAddr{IP: ip}
+		// Binding a listener to it is the simplest check that the
+		// address belongs to this host.
+		ln, err := net.ListenTCP("tcp", sourceAddr)
+		if err != nil {
+			log.Fatalf("Unusable -dial-source-ip %s: %v", dialSourceIP, err)
+		}
+		ln.Close()
 	}
 
-	src := io.TeeReader(res.Body, &WriteCounter{
-		Message: fmt.Sprintf("Wrote %%d bytes to client %v\n", conn.RemoteAddr().String()),
-	})
-	_, err = io.Copy(conn, src)
+	if socks5 && httpConnect {
+		log.Fatal("-socks5 and -http-connect are mutually exclusive")
+	}
+	if forwardedHeader != "" {
+		forwardedHeader = http.CanonicalHeaderKey(forwardedHeader)
+		if forwardedHeader != "X-Forwarded-For" && forwardedHeader != "Forwarded" {
+			log.Fatalf("Invalid -forwarded-header %q: must be X-Forwarded-For or Forwarded", forwardedHeader)
+		}
+		// The CONNECT request is sent before the client's PROXY header
+		// has been read, so the address it names isn't known in time.
+		if acceptProxyProtocol {
+			log.Fatal("-forwarded-header cannot be combined with -accept-proxy-protocol")
+		}
+	}
+	if (socks5 || httpConnect) && acceptProxyProtocol {
+		log.Fatal("-socks5 and -http-connect cannot be combined with -accept-proxy-protocol")
+	}
+	if requireProxyProtocol && !acceptProxyProtocol {
+		log.Fatal("-require-proxy-protocol requires -accept-proxy-protocol")
+	}
+	if loopbackOnly {
+		if socks5 || httpConnect {
+			log.Fatal("-reject-non-loopback-target cannot be combined with -socks5 or -http-connect, as their clients choose the target")
+		}
+		targets := []string{target}
+		for _, r := range targetMap {
+			targets = append(targets, r.Target)
+		}
+		for _, t := range sniTargets {
+			targets = append(targets, t)
+		}
+		for _, t := range targets {
+			if err := checkLoopback(t); err != nil {
+				log.Fatalf("-reject-non-loopback-target: %v", err)
+			}
+		}
+	}
+
+	if maxHeaderBytes < 0 || int64(maxHeaderBytes) > math.MaxUint32 {
+		log.Fatalf("Invalid -max-header-bytes %d", maxHeaderBytes)
+	}
+	if maxIdleConns < 0 {
+		log.Fatalf("Invalid -max-idle-conns %d: must not be negative", maxIdleConns)
+	}
+	if maxStreamsPerConn < 0 {
+		log.Fatalf("Invalid -max-streams-per-conn %d: must not be negative", maxStreamsPerConn)
+	}
+	if closeMode != "reset" && closeMode != "graceful" {
+		log.Fatalf("Invalid -close-mode %q: must be reset or graceful", closeMode)
+	}
+
+	var resolver *net.Resolver
+	if dnsResolver != "" {
+		if _, _, err := net.SplitHostPort(dnsResolver); err != nil {
+			log.Fatalf("Invalid -dns-resolver %q: %v", dnsResolver, err)
+		}
+		if dnsProtocol != "udp" && dnsProtocol != "tcp" {
+			log.Fatalf("Invalid -dns-protocol %q: must be udp or tcp", dnsProtocol)
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, dnsProtocol, dnsResolver)
+			},
+		}
+	}
+
+	if listenBacklog < 0 {
+		log.Fatalf("Invalid -listen-backlog %d: must not be negative", listenBacklog)
+	}
+	if listenBacklog > 0 && !listenBacklogSupported {
+		log.Printf("WARNING: -listen-backlog is not supported on this platform and will be ignored")
+		listenBacklog = 0
+	}
+	if reusePort && !reusePortSupported {
+		log.Printf("WARNING: -reuse-port is not supported on this platform and will be ignored")
+		reusePort = false
+	}
+
+	if onOverflow != "wait" && onOverflow != "reject" {
+		log.Fatalf("Invalid -on-overflow %q: must be wait or reject", onOverflow)
+	}
+
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["port"] || setFlags["bind"] {
+		if setFlags["listen"] {
+			log.Printf("Both -listen and -port or -bind given; they are deprecated and will be ignored")
+		} else if _, _, err := net.SplitHostPort(port); err == nil {
+			// -port already names a host.
+			listen = port
+		} else {
+			listen = net.JoinHostPort(bind, port)
+		}
+	}
+
+	var logOut io.Writer = os.Stderr
+	var logw *logFile
+	if logFilePath != "" {
+		if logMaxSize < 0 || logMaxBackups < 0 {
+			log.Fatal("-log-max-size and -log-max-backups must not be negative")
+		}
+		logw, err = openLogFile(logFilePath, int64(logMaxSize)<<20, logMaxBackups)
+		if err != nil {
+			log.Fatalf("Invalid -log-file: %v", err)
+		}
+		logOut = logw
+		log.SetOutput(logOut)
+	}
+
+	var debugLog *log.Logger
+	switch logFormat {
+	case "text":
+		if debug {
+			debugLog = log.New(logOut, log.Prefix(), log.Flags())
+		} else {
+			debugLog = log.New(ioutil.Discard, log.Prefix(), log.Flags())
+		}
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(proxy.NewJSONLogWriter(logOut, "info"))
+		if debug {
+			debugLog = log.New(proxy.NewJSONLogWriter(logOut, "debug"), "", 0)
+		} else {
+			debugLog = log.New(ioutil.Discard, "", 0)
+		}
+	default:
+		log.Fatalf("Invalid -log-format %q: must be text or json", logFormat)
+	}
+
+	requestHeader := http.Header(connectHeaders).Clone()
+	if requestHeader == nil {
+		requestHeader = http.Header{}
+	}
+	if proxyUser != "" || proxyPass != "" {
+		if proxyAuthHeader != "" {
+			log.Fatal("-proxy-auth-header cannot be combined with -proxy-user/-proxy-pass")
+		}
+		creds := base64.StdEncoding.EncodeToString([]byte(proxyUser + ":" + proxyPass))
+		proxyAuthHeader = "Basic " + creds
+	}
+	if proxyAuthHeader != "" {
+		requestHeader.Set("Proxy-Authorization", proxyAuthHeader)
+	}
+
+	var tokenSource func() string
+	if bearerToken != "" && bearerTokenFile != "" {
+		log.Fatal("-bearer-token and -bearer-token-file are mutually exclusive")
+	}
+	if bearerToken != "" {
+		tokenSource = func() string { return bearerToken }
+	}
+	if bearerTokenFile != "" {
+		tf := &tokenFile{path: bearerTokenFile}
+		if err := tf.load(); err != nil {
+			log.Fatalf("Unable to read -bearer-token-file: %v", err)
+		}
+		go tf.watch()
+		tokenSource = tf.get
+	}
+
+	var backendURLs []*url.URL
+	schemes := map[string]bool{}
+	for _, backend := range backends {
+		url, err := url.Parse(backend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if url.Scheme != "https" && url.Scheme != "http" {
+			log.Fatalf("Invalid -backend %q: scheme must be https or http", backend)
+		}
+		schemes[url.Scheme] = true
+		backendURLs = append(backendURLs, url)
+	}
+	// For h2 every backend is dialed the same way, so http:// (h2c) means
+	// -plaintext. H1Transport picks TLS per backend from the scheme.
+	if protocol == "h2" {
+		if schemes["http"] && schemes["https"] {
+			log.Fatal("-backend URLs cannot mix http and https with -protocol h2")
+		}
+		if schemes["http"] {
+			plaintext = true
+		} else if plaintext {
+			log.Printf("WARNING: -plaintext connects to https backends without TLS; use http:// backend URLs instead")
+		}
+	}
+
+	// Only https backends are dialed with TLS, and -plaintext turns that
+	// off for them too.
+	var keyLog io.Writer
+	if keyLogFile != "" && schemes["https"] && !plaintext {
+		keyLog, err = openKeyLog(keyLogFile)
+		if err != nil {
+			log.Fatalf("Invalid -keylog: %v", err)
+		}
+		log.Printf("WARNING: writing TLS keys to %s; anyone who can read it can decrypt backend traffic", keyLogFile)
+	}
+
+	// The transports clone tlsConfig for each dial, so the key log is set
+	// up here once rather than in dialContext.
+	tlsConfig := &tls.Config{KeyLogWriter: keyLog}
+	switch minTLS {
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		log.Fatalf("Invalid -min-tls %q: must be 1.2 or 1.3", minTLS)
+	}
+	files := &tlsFiles{caFile: caCert}
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			log.Fatal("-client-cert and -client-key must be given together")
+		}
+		files.certFile, files.keyFile = clientCert, clientKey
+		if err := files.loadCert(); err != nil {
+			log.Fatalf("Unable to load client certificate: %v", err)
+		}
+		tlsConfig.GetClientCertificate = files.clientCertificate
+	}
+	if caCert != "" {
+		if err := files.loadCA(); err != nil {
+			log.Fatalf("Unable to read -cacert: %v", err)
+		}
+		tlsConfig.RootCAs = files.rootCAs()
+	}
+	if sniFromTarget && sni != "" {
+		log.Fatal("-backend-sni-from-target cannot be combined with -sni")
+	}
+	if sni != "" {
+		// The transport only derives ServerName from the dial address when
+		// it is empty, so this also covers IP literal -backend hosts.
+		tlsConfig.ServerName = sni
+	}
+	if tlsSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+	}
+	if insecure {
+		log.Printf("WARNING: -insecure given, backend TLS certificates will NOT be verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if trace && protocol != "h2" {
+		log.Printf("-trace only applies to -protocol h2 and will be ignored")
+		trace = false
+	}
+	bd := &backendDialer{
+		dialer:        net.Dialer{KeepAlive: keepAlivePeriod(tcpKeepAlive), Resolver: resolver},
+		timeout:       dialTimeout,
+		noDelay:       tcpNoDelay,
+		plaintext:     plaintext,
+		sniFromTarget: sniFromTarget,
+		quiet:         quiet,
+		debugLog:      debugLog,
+		wrap: func(conn net.Conn, addr string) net.Conn {
+			conn = proxy.WrapConnection(conn, debugLog)
+			if trace {
+				conn = proxy.TraceFrames(conn, addr, log.Default())
+			}
+			return conn
+		},
+	}
+	if sourceAddr != nil { // a nil *net.TCPAddr would not be a nil net.Addr
+		bd.dialer.LocalAddr = sourceAddr
+	}
+	if caCert != "" {
+		bd.files = files
+	}
+	dialContext := bd.dialContext
+	var tr http.RoundTripper
+	switch protocol {
+	case "h2":
+		h2 := &http2.Transport{
+			DialTLSContext:             dialContext,
+			TLSClientConfig:            tlsConfig,
+			AllowHTTP:                  plaintext,
+			ReadIdleTimeout:            readIdleTimeout,
+			PingTimeout:                pingTimeout,
+			StrictMaxConcurrentStreams: strictMaxStreams,
+			MaxHeaderListSize:          uint32(maxHeaderBytes),
+		}
+		// The stock pool shares a connection between all targets, which
+		// would leave tunnels on a connection whose SNI names another, and
+		// never closes idle connections itself.
+		if maxStreamsPerConn > 0 || sniFromTarget || maxIdleConns > 0 || idleConnTimeout > 0 {
+			h2.ConnPool = &proxy.StreamPool{
+				Transport:   h2,
+				MaxStreams:  maxStreamsPerConn,
+				KeyByTarget: sniFromTarget,
+				IdleTimeout: idleConnTimeout,
+				MaxIdle:     maxIdleConns,
+			}
+		}
+		tr = h2
+	case "h1":
+		tr = &proxy.H1Transport{
+			DialTLSContext: dialContext,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialContext(ctx, network, addr, nil)
+			},
+			TLSClientConfig: tlsConfig,
+			MaxHeaderBytes:  maxHeaderBytes,
+		}
+	default:
+		log.Fatalf("Invalid -protocol %q: must be h2 or h1", protocol)
+	}
+	//c := &http.Client{Transport: transport}
+
+	p := &proxy.Proxy{
+		Backends:            backendURLs,
+		Target:              target,
+		Transport:           tr,
+		Header:              header,
+		RequestHeader:       requestHeader,
+		ForwardedHeader:     forwardedHeader,
+		BearerToken:         tokenSource,
+		Metrics:             proxy.NewMetrics(),
+		Log:                 log.Default(),
+		DebugLog:            debugLog,
+		BufferSize:          bufferSize,
+		MaxConnections:      maxConnections,
+		RejectOverflow:      onOverflow == "reject",
+		ConnectRetries:      connectRetries,
+		ConnectRetryDelay:   connectRetryDelay,
+		ConnectTimeout:      connectTimeout,
+		BackendFallback:     backendFallback,
+		HealthInterval:      healthInterval,
+		HealthMaxInterval:   healthMaxInterval,
+		IdleTimeout:         idleTimeout,
+		MaxConnLifetime:     maxConnLifetime,
+		AcceptProxyProtocol: acceptProxyProtocol,
+		RequireProxyHeader:  requireProxyProtocol,
+		LocalIP:             localIP,
+		Resolver:            resolver,
+		HeaderTargetPort:    proxyTargetPort,
+		TargetMap:           targetMap,
+		SNITargets:          sniTargets,
+		RejectUnknownSNI:    rejectUnknownSNI,
+		TargetTLS:           targetTLSConfig,
+		AccessLog:           verbose,
+		AllowCIDRs:          allowCIDRs,
+		DenyCIDRs:           denyCIDRs,
+		ConnRate:            connRate,
+		ConnBurst:           connBurst,
+		SOCKS5:              socks5,
+		WriteTimeout:        writeTimeout,
+		HTTPConnect:         httpConnect,
+		GracefulClose:       closeMode == "graceful",
+		RetryRefused:        retryRefused,
+		RetryGoAway:         retryGoAway,
+		MaxHeaderBytes:      maxHeaderBytes,
+		Quiet:               quiet,
+		StatsInterval:       statsInterval,
+	}
+
+	if metricsAddr != "" {
+		go serveHTTP("metrics", metricsAddr, "/metrics", p.Metrics)
+	}
+	if healthAddr != "" {
+		go serveHTTP("health checks", healthAddr, "/healthz", p.HealthHandler())
+	}
+	if adminAddr != "" {
+		go serveHTTP("drain control", adminAddr, "/", p.DrainHandler())
+	}
+	if debugAddr != "" {
+		go serveHTTP("connection state", debugAddr, "/connections", p.ConnectionsHandler())
+	}
+	if pprofAddr != "" {
+		go serveHTTP("pprof", pprofAddr, "/debug/pprof/", pprofHandler())
+	}
+
+	ln, err := systemdListener()
+	if err == nil && ln == nil {
+		ln, err = listenOn(listen, reusePort)
+		if err == nil && listenBacklog > 0 {
+			if err := setListenBacklog(ln, listenBacklog); err != nil {
+				log.Printf("Unable to set -listen-backlog %d: %v", listenBacklog, err)
+			}
+		}
+	}
 	if err != nil {
-		msg := err.Error()
-		if err := errors.Unwrap(err); err != nil {
-			msg = err.Error()
+		// handle error
+		log.Fatal(err)
+	}
+	if tl, ok := ln.(*net.TCPListener); ok {
+		ln = &tcpListener{TCPListener: tl, keepAlive: tcpKeepAlive, noDelay: tcpNoDelay}
+	}
+	if listenCert != "" || listenKey != "" {
+		cfg, err := listenTLSConfig(listenCert, listenKey, listenClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if acceptProxyProtocol {
+			ln = proxy.HeaderListener(ln)
+		}
+		ln = tls.NewListener(ln, cfg)
+	} else if listenClientCA != "" {
+		log.Fatal("-listen-client-ca requires -listen-cert and -listen-key")
+	} else if sniTargets != nil {
+		log.Fatal("-target-from-sni requires -listen-cert and -listen-key")
+	}
+	log.Printf("Listening on %v (version %s)\n", ln.Addr().String(), versionString())
+	if prewarm || prewarmRequired {
+		if err := p.Prewarm(); err != nil && prewarmRequired {
+			log.Fatalf("Prewarm failed: %v", err)
 		}
-		log.Printf("Client %v got error in io.Copy(conn, res.Body): %v", conn.RemoteAddr().String(), msg)
-		doneError <- true
-		return
 	}
-	done <- true
-}
 
-func copyClient(url *url.URL, conn net.Conn, pw *io.PipeWriter, done chan bool) {
-	defer func() {
-		done <- true
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if files.certFile != "" || files.caFile != "" || logw != nil {
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		go func() {
+			for range hups {
+				if logw != nil {
+					if err := logw.reopen(); err != nil {
+						log.Printf("Failed to reopen -log-file: %v", err)
+					} else {
+						log.Printf("Reopened %s", logFilePath)
+					}
+				}
+				files.reload()
+			}
+		}()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.Serve(ln)
 	}()
-	src := io.TeeReader(conn, &WriteCounter{
-		Message: fmt.Sprintf("Read %%d bytes from client %v\n", conn.RemoteAddr().String()),
-	})
 
-	io.Copy(pw, src)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case sig := <-sigs:
+		log.Printf("Received %v, no longer accepting connections", sig)
+	}
+	drained, forced := p.Shutdown(drainTimeout)
+	log.Printf("Shutdown complete: %d connections drained, %d force-closed", drained, forced)
+}
+
+// tcpListener applies the TCP options to accepted connections: the
+// keepalive period, with zero disabling keepalives, and TCP_NODELAY.
+type tcpListener struct {
+	*net.TCPListener
+	keepAlive time.Duration
+	noDelay   bool
 }
 
-func handleConnection(url *url.URL, tr *http2.Transport, conn net.Conn) {
-	done := make(chan bool, 2)
-	doneError := make(chan bool, 1)
+func (l *tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(l.keepAlive > 0)
+	if l.keepAlive > 0 {
+		conn.SetKeepAlivePeriod(l.keepAlive)
+	}
+	conn.SetNoDelay(l.noDelay)
+	return conn, nil
+}
 
-	pr, pw := io.Pipe()
+// keepAlivePeriod converts a -tcp-keepalive value to net.Dialer.KeepAlive,
+// where zero means the default period rather than off.
+func keepAlivePeriod(d time.Duration) time.Duration {
+	if d <= 0 {
+		return -1
+	}
+	return d
+}
 
-	go copyProxy(url, tr, conn, pr, done, doneError)
-	go copyClient(url, conn, pw, done)
+// listenTLSConfig returns the TLS configuration for the client-facing
+// listener, requiring client certificates signed by clientCA if it is set.
+func listenTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-listen-cert and -listen-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load listener certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read -listen-client-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -listen-client-ca %s", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
 
-	select {
-	case <-done:
-	case <-doneError:
-		if conn, ok := conn.(*net.TCPConn); ok {
-			conn.SetLinger(0)
+// targetTLSConfigFor returns the TLS configuration for -target-tls, kept
+// apart from the one for backend connections.
+func targetTLSConfigFor(caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read -target-tls-ca: %w", err)
 		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -target-tls-ca %s", caFile)
+		}
+		cfg.RootCAs = pool
 	}
-	conn.Close()
-	pw.Close()
+	return cfg, nil
 }
 
-func addKeyLogWriter(cfg *tls.Config) {
-	fn := os.Getenv("SSLKEYLOGFILE")
-	if fn != "" {
-		w, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// listenOn listens on a TCP host:port or, for a unix:/path address, on a
+// Unix domain socket. A stale socket file left behind by a previous run
+// is removed first; the listener unlinks the socket again when closed.
+// reusePort sets SO_REUSEPORT on TCP listeners.
+func listenOn(addr string, reusePort bool) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		var lc net.ListenConfig
+		if reusePort {
+			lc.Control = setReusePort
+		}
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	// A socket left behind by an instance that has exited refuses
+	// connections and can be replaced; one still being served cannot.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
 		if err == nil {
-			cfg.KeyLogWriter = w
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address in use", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("listen unix %s: %v", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
 		}
 	}
+	return net.Listen("unix", path)
 }
 
-func main() {
-	var debug bool
-	flag.BoolVar(&debug, "debug", false, "enable debug logging")
-	var backend string
-	flag.StringVar(&backend, "backend", "", "URL to Envoy proxy (required)")
-	var port string
-	flag.StringVar(&port, "port", "3306", "port to listen on")
-	flag.Parse()
+// parseTarget checks that target is a host and numeric port, returning
+// it in canonical form.
+func parseTarget(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("%q: port must be numeric", target)
+	}
+	return net.JoinHostPort(host, port), nil
+}
 
-	if backend == "" {
-		fmt.Println("-backend flag is required")
-		os.Exit(1)
+// checkLoopback resolves the host of target, a host:port, and fails unless
+// every address it has is a loopback address.
+func checkLoopback(target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !ip.IP.IsLoopback() {
+			return fmt.Errorf("target %s resolves to %v, which is not a loopback address", target, ip.IP)
+		}
 	}
+	return nil
+}
+
+// targetMap is a flag.Value collecting cidr=host:port rules, parsed as
+// they are set.
+type targetMap []proxy.TargetRule
 
-	if debug {
-		debugLog = log.New(os.Stderr, log.Prefix(), log.Flags())
-	} else {
-		debugLog = log.New(ioutil.Discard, log.Prefix(), log.Flags())
+func (m *targetMap) String() string {
+	var s []string
+	for _, r := range *m {
+		s = append(s, r.Net.String()+"="+r.Target)
 	}
+	return strings.Join(s, ",")
+}
 
-	url, err := url.Parse(backend)
-	if err != nil {
-		log.Fatal(err)
+func (m *targetMap) Set(value string) error {
+	for _, rule := range strings.Split(value, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q: want cidr=host:port", rule)
+		}
+		_, n, err := net.ParseCIDR(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return err
+		}
+		target, err := parseTarget(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return err
+		}
+		*m = append(*m, proxy.TargetRule{Net: n, Target: target})
+	}
+	return nil
+}
+
+// sniMap is a flag.Value collecting name=host:port rules for
+// -target-from-sni, keyed by the lower-cased server name.
+type sniMap map[string]string
+
+func (m *sniMap) String() string {
+	var s []string
+	for name, target := range *m {
+		s = append(s, name+"="+target)
 	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
 
-	dial := func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-		log.Printf("Connecting to %s\n", addr)
-		dialer := &net.Dialer{Timeout: 5 * time.Second}
-		addKeyLogWriter(cfg)
-		conn, err := tls.DialWithDialer(dialer, network, addr, cfg)
+func (m *sniMap) Set(value string) error {
+	for _, rule := range strings.Split(value, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("%q: want name=host:port", rule)
+		}
+		target, err := parseTarget(strings.TrimSpace(parts[1]))
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if *m == nil {
+			*m = sniMap{}
 		}
-		return WrapConnection(conn), nil
+		(*m)[strings.ToLower(strings.TrimSpace(parts[0]))] = target
 	}
-	tr := &http2.Transport{DialTLS: dial, ReadIdleTimeout: 60 * time.Second}
-	//c := &http.Client{Transport: transport}
+	return nil
+}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%s", port))
-	if err != nil {
-		// handle error
-		log.Fatal(err)
+// headerFlag is a flag.Value collecting "Name: Value" headers, checked as
+// they are set.
+type headerFlag http.Header
+
+func (h *headerFlag) String() string {
+	var s []string
+	for name, values := range *h {
+		for _, v := range values {
+			s = append(s, name+": "+v)
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (h *headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%q: want Name: Value", value)
+	}
+	name, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if !httpguts.ValidHeaderFieldName(name) {
+		return fmt.Errorf("%q: invalid header name", name)
 	}
-	log.Printf("Listening on %v\n", ln.Addr().String())
-	for {
-		conn, err := ln.Accept()
+	if !httpguts.ValidHeaderFieldValue(v) {
+		return fmt.Errorf("%q: invalid value for %s", v, name)
+	}
+	// These are either set by the transport or not allowed in HTTP/2.
+	switch name = http.CanonicalHeaderKey(name); name {
+	case "Host", "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te", "Content-Length":
+		return fmt.Errorf("%s cannot be set with -connect-header", name)
+	}
+	if *h == nil {
+		*h = headerFlag{}
+	}
+	http.Header(*h).Add(name, v)
+	return nil
+}
+
+type backendList []string
+
+func (l *backendList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *backendList) Set(value string) error {
+	for _, backend := range strings.Split(value, ",") {
+		if backend = strings.TrimSpace(backend); backend != "" {
+			*l = append(*l, backend)
+		}
+	}
+	return nil
+}
+
+// cidrList is a flag.Value collecting CIDR ranges, parsed as they are set.
+type cidrList []*net.IPNet
+
+func (l *cidrList) String() string {
+	var s []string
+	for _, n := range *l {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *cidrList) Set(value string) error {
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
 		if err != nil {
-			// handle error
-			log.Fatal(err)
+			return err
 		}
-		log.Printf("Client connected: %v\n", conn.RemoteAddr().String())
-		go handleConnection(url, tr, conn)
+		*l = append(*l, n)
 	}
+	return nil
+}
 
+// pprofHandler serves the net/http/pprof handlers without registering them
+// on http.DefaultServeMux.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func serveHTTP(name, addr, path string, h http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	log.Printf("Serving %s on %v\n", name, addr)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,67 @@
+package proxy
+
+import "net"
+
+// clientIP returns the IP address of a TCP client, with IPv4-mapped IPv6
+// addresses reduced to plain IPv4, or nil for other kinds of client.
+func clientIP(addr net.Addr) net.IP {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if ip4 := tcp.IP.To4(); ip4 != nil {
+		return ip4
+	}
+	return tcp.IP
+}
+
+// TargetRule sends clients in Net to Target, a host:port.
+type TargetRule struct {
+	Net    *net.IPNet
+	Target string
+}
+
+// targetRule returns the first TargetMap rule that covers conn's client,
+// or nil if none does.
+func (p *Proxy) targetRule(conn net.Conn) *TargetRule {
+	ip := clientIP(conn.RemoteAddr())
+	if ip == nil {
+		return nil
+	}
+	for i := range p.TargetMap {
+		if p.TargetMap[i].Net.Contains(ip) {
+			return &p.TargetMap[i]
+		}
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether conn may be handled. DenyCIDRs is checked
+// first, so a client in both a denied and an allowed range is rejected;
+// then, if AllowCIDRs is not empty, the client must be in one of its
+// ranges. Clients without an IP address, such as those on a Unix socket,
+// are always allowed.
+func (p *Proxy) allowed(conn net.Conn) bool {
+	ip := clientIP(conn.RemoteAddr())
+	if ip == nil {
+		return true
+	}
+	if containsIP(p.DenyCIDRs, ip) {
+		p.Log.Printf("Rejecting client %v: %v is in a denied range", conn.RemoteAddr().String(), ip)
+		return false
+	}
+	if len(p.AllowCIDRs) > 0 && !containsIP(p.AllowCIDRs, ip) {
+		p.Log.Printf("Rejecting client %v: %v is not in an allowed range", conn.RemoteAddr().String(), ip)
+		return false
+	}
+	return true
+}
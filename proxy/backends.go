@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoBackends is returned by Serve when the Proxy has no Backends to
+// tunnel through.
+var ErrNoBackends = errors.New("proxy: no backends")
+
+// pickBackends returns the backends to try for a new connection: the next
+// healthy one in round-robin order followed, when BackendFallback is set,
+// by the other healthy backends and then the unhealthy ones. If no backend
+// is healthy they are all treated as healthy.
+func (p *Proxy) pickBackends() []*url.URL {
+	n := len(p.Backends)
+	start := int((atomic.AddUint32(&p.nextBackend, 1) - 1) % uint32(n))
+
+	healthy := make([]*url.URL, 0, n)
+	var unhealthy []*url.URL
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if atomic.LoadInt32(&p.unhealthy[i]) == 0 {
+			healthy = append(healthy, p.Backends[i])
+		} else {
+			unhealthy = append(unhealthy, p.Backends[i])
+		}
+	}
+	if len(healthy) == 0 {
+		healthy, unhealthy = unhealthy, nil
+	}
+
+	if !p.BackendFallback {
+		return healthy[:1]
+	}
+	return append(healthy, unhealthy...)
+}
+
+// checkBackends probes every backend until the proxy shuts down, marking
+// backends that fail the probe as unhealthy. Healthy backends are probed
+// each HealthInterval; an unhealthy one less often the longer it stays
+// down, up to HealthMaxInterval.
+func (p *Proxy) checkBackends() {
+	delays := make([]time.Duration, len(p.Backends))
+	next := make([]time.Time, len(p.Backends))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-p.closing:
+			return
+		}
+
+		var wake time.Time
+		for i, backend := range p.Backends {
+			if time.Now().After(next[i]) {
+				delays[i] = p.checkBackend(i, backend, delays[i])
+				next[i] = time.Now().Add(delays[i])
+			}
+			if wake.IsZero() || next[i].Before(wake) {
+				wake = next[i]
+			}
+		}
+		timer.Reset(time.Until(wake))
+	}
+}
+
+// checkBackend probes backend i, which has been probed every delay, and
+// returns how long to wait before probing it again.
+func (p *Proxy) checkBackend(i int, backend *url.URL, delay time.Duration) time.Duration {
+	err := p.probe(backend)
+	if err == nil {
+		if atomic.SwapInt32(&p.unhealthy[i], 0) == 1 {
+			p.Log.Printf("Backend %v is healthy again; probing every %v", backend, p.HealthInterval)
+		}
+		return p.HealthInterval
+	}
+	if atomic.SwapInt32(&p.unhealthy[i], 1) == 0 {
+		p.Log.Printf("Backend %v is now unhealthy: %v; probing again in %v", backend, err, p.HealthInterval)
+		return p.HealthInterval
+	}
+	backoff := delay * 2
+	if backoff > p.HealthMaxInterval {
+		backoff = p.HealthMaxInterval
+	}
+	if backoff <= delay {
+		return delay
+	}
+	p.Log.Printf("Backend %v is still unhealthy: %v; backing off to %v", backend, err, backoff)
+	return backoff
+}
+
+// Prewarm probes every backend once, so that the transport already holds
+// a connection (or, for H1Transport, a TLS session) for each when the
+// first client arrives. Failures are logged, and returned together.
+func (p *Proxy) Prewarm() error {
+	p.init()
+	var failures []string
+	for _, backend := range p.Backends {
+		if err := p.probe(backend); err != nil {
+			p.Log.Printf("Failed to prewarm backend %v: %v", backend, err)
+			failures = append(failures, fmt.Sprintf("%v: %v", backend, err))
+			continue
+		}
+		p.Log.Printf("Prewarmed backend %v", backend)
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Drain modes, switched by DrainHandler.
+const (
+	drainOff int32 = iota
+	drainUnready
+	drainRefuse
+)
+
+// DrainHandler returns a handler for POST /drain and POST /undrain.
+// /drain makes the health check fail so that a load balancer stops
+// sending new clients, while existing tunnels carry on; with ?refuse=true
+// new connections are also closed as soon as they are accepted. /undrain
+// puts things back.
+func (p *Proxy) DrainHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		mode := drainUnready
+		if refuse, _ := strconv.ParseBool(r.FormValue("refuse")); refuse {
+			mode = drainRefuse
+		}
+		atomic.StoreInt32(&p.drainMode, mode)
+		if mode == drainRefuse {
+			p.Log.Printf("Draining: failing health checks and refusing new connections")
+		} else {
+			p.Log.Printf("Draining: failing health checks")
+		}
+		fmt.Fprintln(w, "draining")
+	})
+	mux.HandleFunc("/undrain", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		if atomic.SwapInt32(&p.drainMode, drainOff) != drainOff {
+			p.Log.Printf("No longer draining")
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// draining reports whether /drain has been called.
+func (p *Proxy) draining() bool {
+	return atomic.LoadInt32(&p.drainMode) != drainOff
+}
+
+// refusing reports whether conn is to be closed unhandled because of a
+// /drain?refuse=true.
+func (p *Proxy) refusing(conn net.Conn) bool {
+	if atomic.LoadInt32(&p.drainMode) != drainRefuse {
+		return false
+	}
+	p.DebugLog.Printf("Refusing client %v: draining", conn.RemoteAddr().String())
+	return true
+}
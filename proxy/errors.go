@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// errConnectTimeout is returned when the backend doesn't answer a CONNECT
+// request within ConnectTimeout.
+var errConnectTimeout = errors.New("timed out waiting for CONNECT response")
+
+// Classes of error that end an established tunnel, used as metrics labels.
+const (
+	errClientReset  = "client_reset"
+	errBackendReset = "backend_reset"
+	errTimeout      = "timeout"
+	errTLS          = "tls"
+	errStream       = "stream_error"
+)
+
+var copyErrorMessages = map[string]string{
+	errClientReset:  "Client went away",
+	errBackendReset: "Backend tunnel was reset",
+	errTimeout:      "Tunnel timed out",
+	errTLS:          "TLS error on tunnel",
+	errStream:       "Backend reset the HTTP/2 stream",
+}
+
+// classifyCopyError returns the class of an error from copying one
+// direction of a tunnel. clientSide is whether it came from the client
+// connection rather than the backend.
+func classifyCopyError(err error, clientSide bool) string {
+	var streamErr http2.StreamError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return errTimeout
+	case errors.As(err, &streamErr):
+		return errStream
+	case errors.As(err, &recordErr) || strings.Contains(err.Error(), "tls: "):
+		return errTLS
+	case clientSide:
+		return errClientReset
+	}
+	return errBackendReset
+}
+
+// errWriter remembers the error from the last failed Write, so that a copy
+// error can be attributed to the writing side.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *errWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+)
+
+// H1Transport is an http.RoundTripper that tunnels CONNECT requests over
+// HTTP/1.1, for backends that do not speak HTTP/2. After a 200 response
+// the connection is taken over: the request body is copied to it and the
+// response body reads what comes back.
+type H1Transport struct {
+	// DialTLSContext is used for https backends. It has the same signature
+	// as http2.Transport.DialTLSContext so the two can share a dialer.
+	DialTLSContext  func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error)
+	TLSClientConfig *tls.Config
+	// DialContext, if set, is used for http backends.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// MaxHeaderBytes, if non-zero, limits the size of the CONNECT
+	// response's status line and headers.
+	MaxHeaderBytes int
+}
+
+func (t *H1Transport) dial(req *http.Request) (net.Conn, error) {
+	addr := req.URL.Host
+	switch req.URL.Scheme {
+	case "https":
+		if req.URL.Port() == "" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "443")
+		}
+		cfg := &tls.Config{}
+		if t.TLSClientConfig != nil {
+			cfg = t.TLSClientConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = req.URL.Hostname()
+		}
+		cfg.NextProtos = []string{"http/1.1"}
+		if t.DialTLSContext != nil {
+			return t.DialTLSContext(req.Context(), "tcp", addr, cfg)
+		}
+		d := tls.Dialer{Config: cfg}
+		return d.DialContext(req.Context(), "tcp", addr)
+	case "http":
+		if req.URL.Port() == "" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+		if t.DialContext != nil {
+			return t.DialContext(req.Context(), "tcp", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(req.Context(), "tcp", addr)
+	}
+	return nil, fmt.Errorf("unsupported backend scheme %q", req.URL.Scheme)
+}
+
+func (t *H1Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := t.dial(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abort the handshake if the request is cancelled before it completes.
+	established := make(chan struct{})
+	defer close(established)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			conn.Close()
+		case <-established:
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", req.Host, req.Host)
+	req.Header.Write(w)
+	w.WriteString("\r\n")
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The limit is lifted once the headers are in, as the rest is tunnel.
+	lr := &io.LimitedReader{R: conn, N: math.MaxInt64}
+	if t.MaxHeaderBytes > 0 {
+		lr.N = int64(t.MaxHeaderBytes)
+	}
+	br := bufio.NewReader(lr)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		if lr.N <= 0 {
+			return nil, fmt.Errorf("CONNECT response headers exceed %d bytes", t.MaxHeaderBytes)
+		}
+		return nil, err
+	}
+	lr.N = math.MaxInt64
+	if res.StatusCode != 200 {
+		res.Body = &h1Body{Reader: res.Body, conn: conn}
+		return res, nil
+	}
+
+	if req.Body != nil {
+		go func() {
+			_, err := io.Copy(conn, req.Body)
+			if err != nil || closeWrite(conn) != nil {
+				conn.Close()
+			}
+		}()
+	}
+	res.Body = &h1Body{Reader: br, conn: conn, reqBody: req.Body}
+	return res, nil
+}
+
+type h1Body struct {
+	io.Reader
+	conn    net.Conn
+	reqBody io.Closer
+}
+
+func (b *h1Body) Close() error {
+	if b.reqBody != nil {
+		b.reqBody.Close()
+	}
+	return b.conn.Close()
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// connectRequest is what the test backend saw of a CONNECT request.
+type connectRequest struct {
+	host   string
+	header http.Header
+	// proxyHeader is the raw PROXY header the tunnel started with, and
+	// proxyAddr the source address read from it.
+	proxyHeader []byte
+	proxyAddr   *net.TCPAddr
+}
+
+// tunnelHandler answers a CONNECT accepted by the test backend. body reads
+// the tunnel's client bytes, past any PROXY header.
+type tunnelHandler func(w http.ResponseWriter, r *http.Request, body io.Reader)
+
+// testBackend is an in-process HTTP/2 CONNECT server that the proxy talks
+// to in cleartext over loopback. With proxyProtocol, a tunnel may start
+// with a PROXY header, which is read before the handler is called.
+type testBackend struct {
+	URL      *url.URL
+	requests chan connectRequest
+
+	ln            net.Listener
+	handler       tunnelHandler
+	proxyProtocol bool
+	mu            sync.Mutex
+	conns         map[net.Conn]bool
+}
+
+func newTestBackend(t testing.TB, h tunnelHandler, proxyProtocol bool) *testBackend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBackend{
+		URL:           &url.URL{Scheme: "http", Host: ln.Addr().String()},
+		requests:      make(chan connectRequest, 16),
+		ln:            ln,
+		handler:       h,
+		proxyProtocol: proxyProtocol,
+		conns:         make(map[net.Conn]bool),
+	}
+	go b.serve()
+	t.Cleanup(b.close)
+	return b
+}
+
+func (b *testBackend) serve() {
+	srv := &http2.Server{}
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns[conn] = true
+		b.mu.Unlock()
+		go func() {
+			srv.ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(b.serveConnect)})
+			b.mu.Lock()
+			delete(b.conns, conn)
+			b.mu.Unlock()
+		}()
+	}
+}
+
+func (b *testBackend) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	req := connectRequest{host: r.Host, header: r.Header}
+	var body io.Reader = r.Body
+	if b.proxyProtocol {
+		raw := &headReader{r: r.Body}
+		br := bufio.NewReader(raw)
+		addr, err := readProxyHeader(br)
+		if err != nil && !errors.Is(err, errNoProxyHeader) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			req.proxyHeader = raw.head[:raw.n-br.Buffered()]
+			req.proxyAddr = addr
+		}
+		body = br
+	}
+	select {
+	case b.requests <- req:
+	default:
+	}
+	b.handler(w, r, body)
+}
+
+func (b *testBackend) close() {
+	b.ln.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// transport returns an h2c transport that dials the backend.
+func (b *testBackend) transport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// request returns the next CONNECT request the backend saw.
+func (b *testBackend) request(t testing.TB) connectRequest {
+	t.Helper()
+	select {
+	case req := <-b.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got no CONNECT request")
+	}
+	return connectRequest{}
+}
+
+// headReader counts the bytes read through it and keeps the first
+// maxHead of them, enough for any PROXY header the proxy sends.
+type headReader struct {
+	r    io.Reader
+	n    int
+	head []byte
+}
+
+const maxHead = 256
+
+func (c *headReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	if room := maxHead - len(c.head); room > 0 {
+		if room > n {
+			room = n
+		}
+		c.head = append(c.head, p[:room]...)
+	}
+	return n, err
+}
+
+// echo answers 200 and sends back everything the client sends, ending the
+// response once the client half-closes.
+func echo(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	io.Copy(flushWriter{w}, body)
+}
+
+// flushWriter flushes after every write, so that each chunk goes out as
+// it is written.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.w.(http.Flusher).Flush()
+	return n, err
+}
+
+// newTestProxy returns a Proxy that tunnels to db:3306 through b.
+func newTestProxy(b *testBackend) *Proxy {
+	return &Proxy{
+		Backends:  []*url.URL{b.URL},
+		Target:    "db:3306",
+		Transport: b.transport(),
+		Log:       log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// handle connects a client to p over loopback TCP and hands the accepted
+// end to p.Handle. done is closed once Handle returns.
+func handle(t testing.TB, p *Proxy) (client *net.TCPConn, done <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	ch := make(chan struct{})
+	go func() {
+		p.Handle(conn)
+		close(ch)
+	}()
+	t.Cleanup(func() { c.Close() })
+	return c.(*net.TCPConn), ch
+}
+
+// wait fails t unless done is closed within a few seconds.
+func wait(t testing.TB, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// testCert returns a self-signed certificate for a TLS listener.
+func testCert(t testing.TB) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
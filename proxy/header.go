@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// HeaderBuilder returns the PROXY protocol header to send ahead of the
+// client's bytes, describing a connection from src to dst.
+type HeaderBuilder func(src, dst *net.TCPAddr) ([]byte, error)
+
+// HeaderBuilderFor returns the HeaderBuilder for mode, which is one of v1,
+// v2 or none. none yields a nil HeaderBuilder.
+func HeaderBuilderFor(mode string) (HeaderBuilder, error) {
+	switch mode {
+	case "none":
+		return nil, nil
+	case "v1":
+		return buildProxyHeaderV1, nil
+	case "v2":
+		return buildProxyHeader, nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", mode)
+}
+
+// headerAddrs returns the source and destination IPs in the same form,
+// 4 bytes for IPv4 and 16 for IPv6.
+func headerAddrs(src, dst *net.TCPAddr) (net.IP, net.IP, error) {
+	if s4, d4 := src.IP.To4(), dst.IP.To4(); s4 != nil && d4 != nil {
+		return s4, d4, nil
+	} else if s4 != nil || d4 != nil {
+		return nil, nil, fmt.Errorf("address families of %v and %v differ", src.IP, dst.IP)
+	}
+	return src.IP.To16(), dst.IP.To16(), nil
+}
+
+func buildProxyHeaderV1(src, dst *net.TCPAddr) ([]byte, error) {
+	srcIP, dstIP, err := headerAddrs(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	proto := "TCP6"
+	if len(srcIP) == net.IPv4len {
+		proto = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)), nil
+}
+
+func buildProxyHeader(src, dst *net.TCPAddr) ([]byte, error) {
+	srcIP, dstIP, err := headerAddrs(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	family := byte(0x21)
+	if len(srcIP) == net.IPv4len {
+		family = 0x11
+	}
+
+	length := 2*len(srcIP) + 4
+	b := make([]byte, len(proxyV2Signature)+4+length)
+	n := copy(b, proxyV2Signature)
+	b[n] = 0x21
+	b[n+1] = family
+	binary.BigEndian.PutUint16(b[n+2:], uint16(length))
+	n += 4
+	n += copy(b[n:], srcIP)
+	n += copy(b[n:], dstIP)
+	binary.BigEndian.PutUint16(b[n:], uint16(src.Port))
+	binary.BigEndian.PutUint16(b[n+2:], uint16(dst.Port))
+	return b, nil
+}
+
+// maxHeaderV1 is the longest v1 header allowed by the specification,
+// including the CRLF.
+const maxHeaderV1 = 107
+
+var proxyV1Signature = []byte("PROXY ")
+
+// errNoProxyHeader is returned by readProxyHeader when the client's bytes
+// do not start with a PROXY header, or the read deadline passed before
+// there were enough of them to tell; none of them have been consumed.
+var errNoProxyHeader = errors.New("missing PROXY header")
+
+// readProxyHeader consumes a v1 or v2 PROXY protocol header from r and
+// returns the source address it carries. The address is nil for v1
+// UNKNOWN, v2 LOCAL and address families other than TCP over IPv4 or IPv6.
+//
+// Only as many bytes are waited for as it takes to tell whether there is
+// a header. A client that sends nothing until it hears from the server,
+// as MySQL clients do, is only told apart by the read deadline passing.
+func readProxyHeader(r *bufio.Reader) (*net.TCPAddr, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errNoProxyHeader
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY header: %w", err)
+		}
+		switch {
+		case bytes.Equal(b, proxyV2Signature):
+			return readProxyHeaderV2(r)
+		case bytes.Equal(b, proxyV1Signature):
+			return readProxyHeaderV1(r)
+		case !bytes.HasPrefix(proxyV2Signature, b) && !bytes.HasPrefix(proxyV1Signature, b):
+			return nil, errNoProxyHeader
+		}
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	for len(line) < maxHeaderV1 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY header: line too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed PROXY header source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY header source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*net.TCPAddr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY header version %d", verCmd>>4)
+	}
+	switch verCmd & 0x0F {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY header command %d", verCmd&0x0F)
+	}
+
+	var size int
+	switch family {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("PROXY header too short for address family 0x%02x", family)
+	}
+	ip := make(net.IP, size)
+	copy(ip, body)
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// HeaderListener wraps ln so that Handle can read the PROXY header that
+// starts each of its connections when a TLS listener is layered on top,
+// with AcceptProxyProtocol. Load balancers send the header in the clear,
+// ahead of the client's TLS handshake.
+func HeaderListener(ln net.Listener) net.Listener {
+	return headerListener{ln}
+}
+
+type headerListener struct {
+	net.Listener
+}
+
+func (l headerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &headerConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// headerConn reads conn through r, which Handle reads the PROXY header
+// from, so that the TLS handshake gets whatever r buffered after it.
+type headerConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *headerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *headerConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// localIP returns the local address the system would route traffic to the
+// backend from. It is looked up once per backend host and then cached.
+func (p *Proxy) localIP(u *url.URL) (net.IP, error) {
+	p.localIPMu.Lock()
+	ip, ok := p.localIPs[u.Host]
+	p.localIPMu.Unlock()
+	if ok {
+		return ip, nil
+	}
+	ip, err := getLocalIP(u, p.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	p.localIPMu.Lock()
+	p.localIPs[u.Host] = ip
+	p.localIPMu.Unlock()
+	return ip, nil
+}
+
+// getLocalIP returns the local address the system would route traffic to
+// the backend from, resolving its host with r if it is not nil. Connecting
+// a UDP socket sends nothing; it only selects a route. A nil IP is
+// returned with the error if that fails.
+func getLocalIP(url *url.URL, r *net.Resolver) (net.IP, error) {
+	addr := url.Host
+	if url.Port() == "" {
+		port := "443"
+		if url.Scheme == "http" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(url.Hostname(), port)
+	}
+	d := net.Dialer{Resolver: r}
+	conn, err := d.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP, nil
+	}
+	return nil, fmt.Errorf("unexpected local address %v", conn.LocalAddr())
+}
+
+func getRemotePort(addr net.Addr) (int, bool) {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return addr.Port, true
+	}
+	return 0, false
+}
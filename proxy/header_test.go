@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var headerTests = []struct {
+	name     string
+	src, dst *net.TCPAddr
+	v1       string
+	family   byte
+	// Addresses as they should be decoded, in their header form.
+	srcIP, dstIP net.IP
+}{
+	{
+		name:   "IPv4",
+		src:    &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234},
+		dst:    &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 3306},
+		v1:     "PROXY TCP4 192.0.2.1 198.51.100.7 51234 3306\r\n",
+		family: 0x11,
+		srcIP:  net.IP{192, 0, 2, 1},
+		dstIP:  net.IP{198, 51, 100, 7},
+	},
+	{
+		name:   "IPv6",
+		src:    &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000},
+		dst:    &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		v1:     "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n",
+		family: 0x21,
+		srcIP:  net.ParseIP("2001:db8::1"),
+		dstIP:  net.ParseIP("2001:db8::2"),
+	},
+	{
+		// An IPv4-mapped address is sent as the IPv4 address it maps.
+		name:   "IPv4-mapped",
+		src:    &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1},
+		dst:    &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 65535},
+		v1:     "PROXY TCP4 192.0.2.1 127.0.0.1 1 65535\r\n",
+		family: 0x11,
+		srcIP:  net.IP{192, 0, 2, 1},
+		dstIP:  net.IP{127, 0, 0, 1},
+	},
+	{
+		name: "mismatched families",
+		src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1},
+		dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2},
+	},
+	{
+		name: "IPv4-mapped and IPv6",
+		src:  &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1},
+		dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2},
+	},
+}
+
+func TestBuildProxyHeaderV1(t *testing.T) {
+	for _, tt := range headerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := buildProxyHeaderV1(tt.src, tt.dst)
+			if tt.v1 == "" {
+				if err == nil {
+					t.Fatalf("got header %q, want an error", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.v1 {
+				t.Errorf("got %q, want %q", b, tt.v1)
+			}
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if !addr.IP.Equal(tt.srcIP) || addr.Port != tt.src.Port {
+				t.Errorf("decoded source %v, want %v:%d", addr, tt.srcIP, tt.src.Port)
+			}
+		})
+	}
+}
+
+func TestBuildProxyHeaderV2(t *testing.T) {
+	for _, tt := range headerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := buildProxyHeader(tt.src, tt.dst)
+			if tt.family == 0 {
+				if err == nil {
+					t.Fatalf("got header %x, want an error", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n := len(proxyV2Signature)
+			if !bytes.Equal(b[:n], proxyV2Signature) {
+				t.Fatalf("signature %x, want %x", b[:n], proxyV2Signature)
+			}
+			if b[n] != 0x21 {
+				t.Errorf("version/command 0x%02x, want 0x21", b[n])
+			}
+			if b[n+1] != tt.family {
+				t.Errorf("family 0x%02x, want 0x%02x", b[n+1], tt.family)
+			}
+			size := len(tt.srcIP)
+			if got, want := int(binary.BigEndian.Uint16(b[n+2:])), 2*size+4; got != want || len(b) != n+4+want {
+				t.Fatalf("length %d in a %d byte header, want %d", got, len(b), want)
+			}
+			body := b[n+4:]
+			if ip := net.IP(body[:size]); !ip.Equal(tt.srcIP) {
+				t.Errorf("source %v, want %v", ip, tt.srcIP)
+			}
+			if ip := net.IP(body[size : 2*size]); !ip.Equal(tt.dstIP) {
+				t.Errorf("destination %v, want %v", ip, tt.dstIP)
+			}
+			if port := int(binary.BigEndian.Uint16(body[2*size:])); port != tt.src.Port {
+				t.Errorf("source port %d, want %d", port, tt.src.Port)
+			}
+			if port := int(binary.BigEndian.Uint16(body[2*size+2:])); port != tt.dst.Port {
+				t.Errorf("destination port %d, want %d", port, tt.dst.Port)
+			}
+
+			r := bufio.NewReader(bytes.NewReader(append(b, "data"...)))
+			addr, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if !addr.IP.Equal(tt.srcIP) || addr.Port != tt.src.Port {
+				t.Errorf("decoded source %v, want %v:%d", addr, tt.srcIP, tt.src.Port)
+			}
+			if rest, _ := r.Peek(r.Buffered()); string(rest) != "data" {
+				t.Errorf("left %q after the header, want %q", rest, "data")
+			}
+		})
+	}
+}
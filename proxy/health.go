@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthCacheTTL     = 5 * time.Second
+	healthProbeTimeout = 5 * time.Second
+)
+
+type healthChecker struct {
+	p *Proxy
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// probe sends a bodyless CONNECT to backend and reports whether it was
+// accepted.
+func (p *Proxy) probe(backend *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+	defer cancel()
+
+	req := (&http.Request{
+		Method: "CONNECT",
+		URL:    backend,
+		Host:   p.Target,
+		Header: p.requestHeader(),
+	}).WithContext(withTarget(ctx, p.Target))
+	res, err := p.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("backend returned %s", res.Status)
+	}
+	return nil
+}
+
+func (h *healthChecker) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.checked) > healthCacheTTL {
+		h.err = h.probeAll()
+		h.checked = time.Now()
+	}
+	return h.err
+}
+
+// probeAll succeeds if any backend is reachable.
+func (h *healthChecker) probeAll() error {
+	var failures []string
+	for _, backend := range h.p.Backends {
+		err := h.p.probe(backend)
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("%v: %v", backend, err))
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
+
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.p.draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "draining")
+		return
+	}
+	if err := h.check(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "backend unreachable: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// HealthHandler returns a handler that reports whether any backend accepts
+// CONNECT requests, caching the result for a few seconds. It fails while
+// the proxy is draining.
+func (p *Proxy) HealthHandler() http.Handler {
+	return &healthChecker{p: p}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// httpConnectAccept reads an HTTP CONNECT request from the client of s and
+// points the session at the requested authority. Requests that are not
+// CONNECT, or lack the expected Proxy-Authorization, are answered with an
+// error status and false is returned.
+func (p *Proxy) httpConnectAccept(s *session) bool {
+	br := bufio.NewReader(s.conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		s.log.info.Printf("Reading HTTP CONNECT request failed: %v", err)
+		return false
+	}
+	if req.Method != "CONNECT" {
+		s.log.info.Printf("Rejecting %s request: only CONNECT is supported", req.Method)
+		httpConnectReply(s.conn, http.StatusMethodNotAllowed, "")
+		return false
+	}
+	if want := p.RequestHeader.Get("Proxy-Authorization"); want != "" {
+		got := req.Header.Get("Proxy-Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			s.log.info.Printf("Rejecting CONNECT to %s: missing or wrong Proxy-Authorization", req.Host)
+			httpConnectReply(s.conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+			return false
+		}
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		s.log.info.Printf("Rejecting CONNECT to %q: %v", req.Host, err)
+		httpConnectReply(s.conn, http.StatusBadRequest, "")
+		return false
+	}
+
+	s.log.info.Printf("HTTP CONNECT client requested %s", req.Host)
+	s.client = br
+	s.setTarget(req.Host)
+	s.reply = func(err error) error {
+		var serr *statusError
+		switch {
+		case err == nil:
+			_, err := fmt.Fprintf(s.conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+			return err
+		case errors.As(err, &serr):
+			return httpConnectReply(s.conn, serr.code, "")
+		case errors.Is(err, errConnectTimeout):
+			return httpConnectReply(s.conn, http.StatusGatewayTimeout, "")
+		}
+		return httpConnectReply(s.conn, http.StatusBadGateway, "")
+	}
+	return true
+}
+
+// httpConnectReply sends an empty response with the given status and any
+// extra header lines, each ending in CRLF.
+func httpConnectReply(conn net.Conn, code int, header string) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+	return err
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+type jsonLogWriter struct {
+	out    io.Writer
+	level  string
+	fields []string
+}
+
+// NewJSONLogWriter returns a writer for use with log.New (with no prefix
+// or flags) that emits each log line as a JSON object tagged with level.
+func NewJSONLogWriter(out io.Writer, level string) io.Writer {
+	return &jsonLogWriter{out: out, level: level}
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	w.writeField(&b, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	w.writeField(&b, "level", w.level)
+	b.WriteByte(',')
+	w.writeField(&b, "msg", string(bytes.TrimRight(p, "\n")))
+	for i := 0; i+1 < len(w.fields); i += 2 {
+		b.WriteByte(',')
+		w.writeField(&b, w.fields[i], w.fields[i+1])
+	}
+	b.WriteString("}\n")
+	if _, err := w.out.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) writeField(b *bytes.Buffer, key, value string) {
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	b.Write(k)
+	b.WriteByte(':')
+	b.Write(v)
+}
+
+// withFields returns a logger that adds the given key/value pairs to every
+// line when l writes JSON, and l itself otherwise.
+func withFields(l *log.Logger, kv ...string) *log.Logger {
+	w, ok := l.Writer().(*jsonLogWriter)
+	if !ok {
+		return l
+	}
+	fields := append(append([]string{}, w.fields...), kv...)
+	return log.New(&jsonLogWriter{out: w.out, level: w.level, fields: fields}, l.Prefix(), l.Flags())
+}
+
+type connLog struct {
+	id    string
+	info  *log.Logger
+	debug *log.Logger
+	// routine is info, or a discarding logger when Quiet is set, for the
+	// lines every connection logs.
+	routine *log.Logger
+}
+
+func newConnID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// connLogger tags l with a connection's ID and remote address, as JSON
+// fields or, for text output, as a message prefix.
+func connLogger(l *log.Logger, id, remote string) *log.Logger {
+	if _, ok := l.Writer().(*jsonLogWriter); ok {
+		return withFields(l, "conn_id", id, "remote_addr", remote)
+	}
+	return log.New(l.Writer(), l.Prefix()+"["+id+"] ", l.Flags()|log.Lmsgprefix)
+}
+
+func (p *Proxy) newConnLog(conn net.Conn) connLog {
+	id := newConnID()
+	remote := conn.RemoteAddr().String()
+	cl := connLog{
+		id:    id,
+		info:  connLogger(p.Log, id, remote),
+		debug: connLogger(p.DebugLog, id, remote),
+	}
+	cl.routine = cl.info
+	if p.Quiet {
+		cl.routine = log.New(ioutil.Discard, "", 0)
+	}
+	return cl
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var errorClasses = []string{"roundtrip", "connect_timeout", "target_tls", "status", "slow_client", errClientReset, errBackendReset, errTimeout, errTLS, errStream}
+
+// Metrics holds the counters exported in Prometheus text format by
+// ServeHTTP.
+type Metrics struct {
+	clientToBackend     int64
+	backendToClient     int64
+	activeConnections   int64
+	connections         int64
+	slotsInUse          int64
+	rejectedConnections int64
+	errors              map[string]*int64
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{errors: make(map[string]*int64)}
+	for _, class := range errorClasses {
+		m.errors[class] = new(int64)
+	}
+	return m
+}
+
+func (m *Metrics) connectionError(class string) {
+	atomic.AddInt64(m.errors[class], 1)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP proxy_bytes_client_to_backend_total Bytes read from clients and sent to the backend.\n")
+	fmt.Fprintf(w, "# TYPE proxy_bytes_client_to_backend_total counter\n")
+	fmt.Fprintf(w, "proxy_bytes_client_to_backend_total %d\n", atomic.LoadInt64(&m.clientToBackend))
+	fmt.Fprintf(w, "# HELP proxy_bytes_backend_to_client_total Bytes received from the backend and written to clients.\n")
+	fmt.Fprintf(w, "# TYPE proxy_bytes_backend_to_client_total counter\n")
+	fmt.Fprintf(w, "proxy_bytes_backend_to_client_total %d\n", atomic.LoadInt64(&m.backendToClient))
+	fmt.Fprintf(w, "# HELP proxy_active_connections Client connections currently being proxied.\n")
+	fmt.Fprintf(w, "# TYPE proxy_active_connections gauge\n")
+	fmt.Fprintf(w, "proxy_active_connections %d\n", atomic.LoadInt64(&m.activeConnections))
+	fmt.Fprintf(w, "# HELP proxy_connections_total Client connections handled since startup.\n")
+	fmt.Fprintf(w, "# TYPE proxy_connections_total counter\n")
+	fmt.Fprintf(w, "proxy_connections_total %d\n", atomic.LoadInt64(&m.connections))
+	fmt.Fprintf(w, "# HELP proxy_connection_slots_in_use Connection slots taken when -max-connections is set.\n")
+	fmt.Fprintf(w, "# TYPE proxy_connection_slots_in_use gauge\n")
+	fmt.Fprintf(w, "proxy_connection_slots_in_use %d\n", atomic.LoadInt64(&m.slotsInUse))
+	fmt.Fprintf(w, "# HELP proxy_connections_rejected_total Connections closed because -max-connections was reached.\n")
+	fmt.Fprintf(w, "# TYPE proxy_connections_rejected_total counter\n")
+	fmt.Fprintf(w, "proxy_connections_rejected_total %d\n", atomic.LoadInt64(&m.rejectedConnections))
+	fmt.Fprintf(w, "# HELP proxy_connection_errors_total Connections that ended in an error, by class.\n")
+	fmt.Fprintf(w, "# TYPE proxy_connection_errors_total counter\n")
+	for _, class := range errorClasses {
+		fmt.Fprintf(w, "proxy_connection_errors_total{class=%q} %d\n", class, atomic.LoadInt64(m.errors[class]))
+	}
+}
+
+// logStats logs the aggregate counters every interval until closing is
+// closed, with the connection rate over the last interval.
+func (m *Metrics) logStats(l *log.Logger, interval time.Duration, closing <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, lastTime := atomic.LoadInt64(&m.connections), time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-closing:
+			return
+		}
+		now, conns := time.Now(), atomic.LoadInt64(&m.connections)
+		l.Printf("Stats: %d active connections, %d bytes client to backend, %d bytes backend to client, %.1f connections/s",
+			atomic.LoadInt64(&m.activeConnections),
+			atomic.LoadInt64(&m.clientToBackend),
+			atomic.LoadInt64(&m.backendToClient),
+			float64(conns-last)/now.Sub(lastTime).Seconds())
+		last, lastTime = conns, now
+	}
+}
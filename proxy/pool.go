@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+type targetKey struct{}
+
+func withTarget(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+// TargetFromContext returns the target of the CONNECT request that a
+// Transport's dial is being made for, if ctx is that request's context.
+func TargetFromContext(ctx context.Context) (string, bool) {
+	target, ok := ctx.Value(targetKey{}).(string)
+	return target, ok
+}
+
+// StreamPool is an http2.ClientConnPool that puts at most MaxStreams
+// tunnels on each backend connection, dialing a new one once every
+// existing connection is at the limit.
+//
+// The stock pool only opens another connection once the backend's own
+// SETTINGS_MAX_CONCURRENT_STREAMS is reached (or never, with
+// StrictMaxConcurrentStreams), and until the first SETTINGS frame arrives
+// it assumes a limit of 100. A burst of new clients against a backend that
+// advertises less than that is answered with REFUSED_STREAM; one that
+// advertises more ends up with every tunnel on a single TCP connection and
+// its flow control window. MaxStreams caps both cases from our side.
+type StreamPool struct {
+	// Transport dials new connections with its DialTLSContext and
+	// TLSClientConfig, and sets them up with NewClientConn.
+	Transport *http2.Transport
+	// MaxStreams, if non-zero, is the most tunnels put on one connection.
+	MaxStreams int
+	// KeyByTarget keeps separate connections for each CONNECT target as
+	// well as each backend, for when the dial depends on the target.
+	KeyByTarget bool
+	// IdleTimeout, if non-zero, is how long after a tunnel last asked for
+	// one a backend (or backend and target, with KeyByTarget) keeps a
+	// connection ready: one the backend closes in that time is redialed,
+	// and once it has passed the idle connections are closed. With no IdleTimeout
+	// connections are kept for as long as the backend allows, and not
+	// redialed.
+	IdleTimeout time.Duration
+	// MaxIdle, if non-zero, is the most connections with no tunnels kept
+	// open per backend; the rest are closed.
+	MaxIdle int
+
+	mu        sync.Mutex
+	conns     map[string][]*http2.ClientConn
+	dialing   map[string]chan struct{}
+	used      map[string]poolUse
+	sweepOnce sync.Once
+}
+
+// poolUse is what a background redial needs to know about a key of
+// StreamPool, and when a tunnel last asked for it.
+type poolUse struct {
+	addr, target string
+	last         time.Time
+}
+
+// poolSweepInterval is how often StreamPool checks its idle connections.
+const poolSweepInterval = time.Second
+
+func (p *StreamPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	key := addr
+	if p.KeyByTarget {
+		key += " " + req.Host
+	}
+	if p.IdleTimeout > 0 || p.MaxIdle > 0 {
+		p.sweepOnce.Do(func() { go p.sweep() })
+	}
+	for {
+		p.mu.Lock()
+		p.initLocked()
+		p.used[key] = poolUse{addr: addr, target: req.Host, last: time.Now()}
+		for _, cc := range p.conns[key] {
+			st := cc.State()
+			if st.Closed || st.Closing || (p.MaxStreams > 0 && st.StreamsActive+st.StreamsReserved >= p.MaxStreams) {
+				continue
+			}
+			if cc.ReserveNewRequest() {
+				p.mu.Unlock()
+				return cc, nil
+			}
+		}
+		// Only one dial per backend at a time, so that a burst waits for
+		// it and shares it instead of each opening a connection.
+		done, ok := p.dialing[key]
+		if !ok {
+			break
+		}
+		p.mu.Unlock()
+		select {
+		case <-done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	done := make(chan struct{})
+	p.dialing[key] = done
+	p.mu.Unlock()
+
+	cc, err := p.dial(req, addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dialing, key)
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	cc.ReserveNewRequest()
+	p.conns[key] = append(p.conns[key], cc)
+	return cc, nil
+}
+
+func (p *StreamPool) initLocked() {
+	if p.conns == nil {
+		p.conns = map[string][]*http2.ClientConn{}
+		p.dialing = map[string]chan struct{}{}
+		p.used = map[string]poolUse{}
+	}
+}
+
+// sweep applies IdleTimeout and MaxIdle every poolSweepInterval.
+func (p *StreamPool) sweep() {
+	for range time.Tick(poolSweepInterval) {
+		p.mu.Lock()
+		p.initLocked()
+		for key, use := range p.used {
+			p.sweepKey(key, use)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// sweepKey must be called with p.mu held.
+func (p *StreamPool) sweepKey(key string, use poolUse) {
+	var live, idle []*http2.ClientConn
+	for _, cc := range p.conns[key] {
+		st := cc.State()
+		if st.Closed || st.Closing {
+			continue
+		}
+		live = append(live, cc)
+		if st.StreamsActive+st.StreamsReserved+st.StreamsPending == 0 {
+			idle = append(idle, cc)
+		}
+	}
+	// Tunnels reserve a stream before they are counted as active, so an
+	// idle connection is not one GetClientConn has just handed out.
+	expired := p.IdleTimeout > 0 && time.Since(use.last) > p.IdleTimeout
+	keep := len(idle)
+	if expired {
+		keep = 0
+	} else if p.MaxIdle > 0 && keep > p.MaxIdle {
+		keep = p.MaxIdle
+	}
+	for _, cc := range idle[keep:] {
+		cc.Close()
+	}
+	_, dialing := p.dialing[key]
+	switch {
+	case len(live) > 0:
+		p.conns[key] = live
+	case expired:
+		delete(p.conns, key)
+		delete(p.used, key)
+	case p.IdleTimeout > 0 && !dialing:
+		p.redial(key, use)
+	}
+}
+
+// redial opens a connection for key in the background, as a tunnel
+// still within IdleTimeout would. It must be called with p.mu held.
+func (p *StreamPool) redial(key string, use poolUse) {
+	done := make(chan struct{})
+	p.dialing[key] = done
+	go func() {
+		req := (&http.Request{Host: use.target}).WithContext(withTarget(context.Background(), use.target))
+		cc, err := p.dial(req, use.addr)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.dialing, key)
+		close(done)
+		if err == nil {
+			p.conns[key] = append(p.conns[key], cc)
+		}
+	}()
+}
+
+func (p *StreamPool) dial(req *http.Request, addr string) (*http2.ClientConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if p.Transport.TLSClientConfig != nil {
+		cfg = p.Transport.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	conn, err := p.Transport.DialTLSContext(req.Context(), "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.Transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// MarkDead forgets cc, which the transport has found to be unusable.
+func (p *StreamPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.conns {
+		for i, c := range conns {
+			if c == cc {
+				p.conns[key] = append(conns[:i:i], conns[i+1:]...)
+				if len(p.conns[key]) == 0 {
+					delete(p.conns, key)
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,864 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyHeaderTimeout is how long RequireProxyHeader waits for a PROXY
+// header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// optionalHeaderTimeout is how long AcceptProxyProtocol waits for a PROXY
+// header when it isn't required. A load balancer sends it as soon as it
+// connects, so a client silent for longer has none, and most likely waits
+// for the target to speak first.
+const optionalHeaderTimeout = 200 * time.Millisecond
+
+// handshakeTimeout bounds a client's TLS, SOCKS5 or HTTP CONNECT handshake,
+// which comes before IdleTimeout and MaxConnLifetime start counting.
+const handshakeTimeout = 10 * time.Second
+
+const DefaultBufferSize = 32 * 1024
+
+// Proxy accepts TCP connections and tunnels each one to Target through an
+// HTTP/2 CONNECT request sent to one of Backends, chosen round-robin.
+type Proxy struct {
+	Backends  []*url.URL
+	Target    string
+	Transport http.RoundTripper
+	Header    HeaderBuilder
+	// RequestHeader is sent with every CONNECT request, e.g. to carry
+	// Proxy-Authorization.
+	RequestHeader http.Header
+	// ForwardedHeader, if set, is X-Forwarded-For or Forwarded, and names
+	// the client's address in every CONNECT request.
+	ForwardedHeader string
+	// BearerToken, if set, is called for every CONNECT request and a
+	// non-empty result is sent as an Authorization: Bearer header.
+	BearerToken func() string
+	Metrics     *Metrics
+	Log         *log.Logger
+	DebugLog    *log.Logger
+	// BufferSize is the size of the buffers used to copy data in each
+	// direction. It defaults to DefaultBufferSize.
+	BufferSize int
+	// MaxConnections caps the number of connections handled at once. Zero
+	// means unlimited. Once the cap is reached Serve stops accepting until
+	// a slot frees up, or, with RejectOverflow, closes new connections
+	// straight away.
+	MaxConnections int
+	RejectOverflow bool
+	// ConnectRetries is how many times a failed CONNECT is retried before
+	// the client is disconnected, waiting ConnectRetryDelay before the
+	// first retry and doubling the wait each time after that.
+	ConnectRetries    int
+	ConnectRetryDelay time.Duration
+	// ConnectTimeout, if non-zero, bounds how long each CONNECT request
+	// waits for the backend's response, dial included.
+	ConnectTimeout time.Duration
+	// BackendFallback makes a connection whose backend cannot be reached
+	// try each of the other backends in turn.
+	BackendFallback bool
+	// IdleTimeout, if non-zero, closes a connection once no data has
+	// flowed in either direction for that long.
+	IdleTimeout time.Duration
+	// MaxConnLifetime, if non-zero, resets connections that have been open
+	// for that long regardless of activity.
+	MaxConnLifetime time.Duration
+	// HealthInterval, if non-zero, is how often Serve probes each backend
+	// in the background so that connections avoid unhealthy ones.
+	HealthInterval time.Duration
+	// HealthMaxInterval caps how far probing of an unhealthy backend backs
+	// off, doubling from HealthInterval after each failure. At or below
+	// HealthInterval there is no backoff.
+	HealthMaxInterval time.Duration
+	// AcceptProxyProtocol makes each connection start with a PROXY
+	// protocol header, v1 or v2, naming the real client. The header is
+	// stripped and its source address used in the one sent to the target.
+	// With TLS client connections the header comes before the handshake,
+	// and the listener under the TLS one must be wrapped by HeaderListener.
+	AcceptProxyProtocol bool
+	// RequireProxyHeader rejects clients that do not send a PROXY header
+	// within proxyHeaderTimeout, when AcceptProxyProtocol is set. Without
+	// it, a client with no header is passed on with its own address, once
+	// its first bytes show there is none or optionalHeaderTimeout passes.
+	RequireProxyHeader bool
+	// AccessLog logs a summary of each connection when it closes: the
+	// backend used, bytes in each direction, duration and why it closed.
+	AccessLog bool
+	// AllowCIDRs, if not empty, limits the clients that are handled to
+	// those whose address falls in one of the ranges.
+	AllowCIDRs []*net.IPNet
+	// DenyCIDRs lists ranges whose clients are always rejected, even if
+	// they are also in AllowCIDRs.
+	DenyCIDRs []*net.IPNet
+	// ConnRate, if non-zero, limits how many new connections per second
+	// each source IP may open, allowing bursts of up to ConnBurst.
+	ConnRate  float64
+	ConnBurst int
+	// WriteTimeout, if non-zero, closes a connection whose client has not
+	// accepted a write for that long.
+	WriteTimeout time.Duration
+	// GracefulClose makes connections that are torn down early (on errors,
+	// timeouts and shutdown) end with a FIN instead of a reset.
+	GracefulClose bool
+	// RetryRefused retries a CONNECT once more, without waiting, if the
+	// backend refuses the stream with REFUSED_STREAM before any client
+	// bytes were sent. The transport then picks or dials a connection with
+	// room for it.
+	RetryRefused bool
+	// RetryGoAway likewise retries a CONNECT once when the backend
+	// connection is shut down with GOAWAY, as during a graceful restart.
+	// Client bytes are replayed if the GOAWAY says the stream was not
+	// processed; otherwise it is only retried if none were sent.
+	RetryGoAway bool
+	// MaxHeaderBytes, if non-zero, also bounds how much of a non-200
+	// CONNECT response body is read for logging, which is otherwise
+	// limited to 512 bytes. The headers themselves are limited by the
+	// Transport.
+	MaxHeaderBytes int
+	// Quiet leaves out the lines logged for every connection, such as
+	// "Client connected", keeping errors and other events.
+	Quiet bool
+	// StatsInterval, if non-zero, is how often Serve logs the aggregate
+	// connection and byte counters.
+	StatsInterval time.Duration
+	// SOCKS5 makes each client start with a SOCKS5 handshake naming its
+	// own destination, which is tunneled to in place of Target.
+	SOCKS5 bool
+	// HTTPConnect makes each client start with an HTTP/1.1 CONNECT request
+	// naming its own destination, as for a forward proxy. If RequestHeader
+	// carries Proxy-Authorization, clients must send the same value.
+	HTTPConnect bool
+	// LocalIP, if set, is the address advertised as this proxy's in the
+	// PROXY header instead of the one used to reach the first backend.
+	LocalIP net.IP
+	// Resolver, if set, looks up backend hostnames in place of the system
+	// resolver when finding the address used to reach them.
+	Resolver *net.Resolver
+	// HeaderTargetPort, if non-zero, is the destination port given in the
+	// PROXY header instead of the port of the tunnel's target.
+	HeaderTargetPort int
+	// TargetMap picks the target by client address: the first rule whose
+	// range contains the client's IP is used in place of Target.
+	TargetMap []TargetRule
+	// SNITargets picks the target of a TLS client by the server name it
+	// asked for, keyed in lower case, taking precedence over TargetMap.
+	// Clients whose name is not in it keep the target they would
+	// otherwise have, unless RejectUnknownSNI is set.
+	SNITargets       map[string]string
+	RejectUnknownSNI bool
+	// TargetTLS, if set, wraps each tunnel in a TLS session of its own
+	// with the target, over the CONNECT stream, before any client bytes
+	// are sent. ServerName defaults to the target's host.
+	TargetTLS *tls.Config
+
+	initOnce    sync.Once
+	nextBackend uint32
+	unhealthy   []int32
+	slots       chan struct{}
+	targetPort  int
+	buffers     sync.Pool
+	tracker     *connTracker
+	ctx         context.Context
+	cancel      context.CancelFunc
+	mu          sync.Mutex
+	ln          net.Listener
+	closing     chan struct{}
+	limiter     *connLimiter
+	registry    *registry
+	drainMode   int32 // accessed atomically
+	localIPMu   sync.Mutex
+	localIPs    map[string]net.IP // by backend host, once found
+}
+
+func (p *Proxy) init() {
+	p.initOnce.Do(func() {
+		if p.Log == nil {
+			p.Log = log.Default()
+		}
+		if p.DebugLog == nil {
+			p.DebugLog = log.New(ioutil.Discard, "", 0)
+		}
+		if p.Metrics == nil {
+			p.Metrics = NewMetrics()
+		}
+		if _, port, err := net.SplitHostPort(p.Target); err == nil {
+			p.targetPort, _ = strconv.Atoi(port)
+		}
+		if p.BufferSize <= 0 {
+			p.BufferSize = DefaultBufferSize
+		}
+		p.buffers.New = func() interface{} {
+			b := make([]byte, p.BufferSize)
+			return &b
+		}
+		if p.MaxConnections > 0 {
+			p.slots = make(chan struct{}, p.MaxConnections)
+		}
+		p.unhealthy = make([]int32, len(p.Backends))
+		p.tracker = newConnTracker()
+		p.registry = newRegistry()
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+		p.closing = make(chan struct{})
+		p.localIPs = make(map[string]net.IP)
+		if p.ConnRate > 0 {
+			p.limiter = newConnLimiter(p.ConnRate, p.ConnBurst)
+		}
+	})
+}
+
+func WrapConnection(c net.Conn, debugLog *log.Logger) net.Conn {
+	return &spyConnection{
+		Conn:     c,
+		debugLog: debugLog,
+	}
+}
+
+type spyConnection struct {
+	net.Conn
+	debugLog *log.Logger
+}
+
+// reset makes the coming Close of conn send an RST, so that the client
+// does not mistake a tunnel torn down early for a clean end of stream.
+func (p *Proxy) reset(conn net.Conn) {
+	if p.GracefulClose {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if hc, ok := conn.(*headerConn); ok {
+		conn = hc.Conn
+	}
+	if conn, ok := conn.(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
+}
+
+func closeWrite(conn net.Conn) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection does not support CloseWrite")
+	}
+	return cw.CloseWrite()
+}
+
+func (sc *spyConnection) CloseWrite() error {
+	return closeWrite(sc.Conn)
+}
+
+func (sc *spyConnection) Read(b []byte) (int, error) {
+	n, err := sc.Conn.Read(b)
+	if err != nil {
+		return n, err
+	}
+	sc.debugLog.Printf("Read %d bytes from proxy", n)
+	return n, nil
+}
+
+func (sc *spyConnection) Write(b []byte) (int, error) {
+	n, err := sc.Conn.Write(b)
+	if err != nil {
+		sc.debugLog.Printf("Wrote %d of %d bytes to proxy: %v", n, len(b), err)
+		return n, err
+	}
+	sc.debugLog.Printf("Wrote %d bytes to proxy", n)
+	return n, nil
+}
+
+// WriteCounter counts the bytes written to it, as the tap on one
+// direction of a tunnel. It is on the path of every chunk, so it only
+// updates counters; the totals are logged when the direction ends.
+type WriteCounter struct {
+	Total *int64
+	// Session, if set, is a second counter for the connection's own total.
+	Session *int64
+	// LastActive, if set, is updated with the time of each write in
+	// nanoseconds since the Unix epoch.
+	LastActive *int64
+}
+
+func (wc *WriteCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	if wc.Total != nil {
+		atomic.AddInt64(wc.Total, int64(n))
+	}
+	if wc.Session != nil {
+		atomic.AddInt64(wc.Session, int64(n))
+	}
+	if wc.LastActive != nil {
+		atomic.StoreInt64(wc.LastActive, time.Now().UnixNano())
+	}
+	return n, nil
+}
+
+// deadlineWriter bounds how long each Write to conn may block.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return 0, err
+	}
+	return w.conn.Write(b)
+}
+
+func (p *Proxy) copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.buffers.Get().(*[]byte)
+	defer p.buffers.Put(buf)
+	// Hide any ReaderFrom implementation (e.g. *net.TCPConn) so that
+	// io.CopyBuffer uses the pooled buffer instead of allocating its own.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
+
+type copyEvent int
+
+const (
+	clientEOF copyEvent = iota
+	clientError
+	backendEOF
+	backendError
+	connectFailed
+	slowClient
+)
+
+// failed reports whether e ends the tunnel rather than one direction.
+func (e copyEvent) failed() bool {
+	return e != clientEOF && e != backendEOF
+}
+
+func (e copyEvent) String() string {
+	switch e {
+	case clientEOF:
+		return "client EOF"
+	case clientError:
+		return "client error"
+	case backendEOF:
+		return "backend EOF"
+	case backendError:
+		return "backend error"
+	case connectFailed:
+		return "connect failed"
+	case slowClient:
+		return "slow client"
+	}
+	return "unknown"
+}
+
+// fromClient reports whether e ends the client to backend direction
+// rather than backend to client.
+func (e copyEvent) fromClient() bool {
+	return e == clientEOF || e == clientError
+}
+
+// end describes how e ended its direction, for the access log.
+func (e copyEvent) end() string {
+	switch e {
+	case clientEOF, backendEOF:
+		return "EOF"
+	case clientError, backendError:
+		return "error"
+	}
+	return e.String()
+}
+
+func (p *Proxy) copyProxy(ctx context.Context, s *session, pr io.ReadCloser, pw *io.PipeWriter, events chan<- copyEvent) {
+	conn, cl := s.conn, s.log
+	res, backend, err := p.connect(ctx, s, pr)
+	if err != nil {
+		var serr *statusError
+		if errors.As(err, &serr) {
+			cl.info.Printf("Backend refused CONNECT with status %d (%s): %q", serr.code, serr.status, serr.body)
+			if serr.code == http.StatusProxyAuthRequired {
+				cl.info.Printf("Backend rejected CONNECT with %s: check the proxy credentials", serr.status)
+			}
+			p.Metrics.connectionError("status")
+		} else if errors.Is(err, errConnectTimeout) {
+			p.Metrics.connectionError("connect_timeout")
+		} else {
+			p.Metrics.connectionError("roundtrip")
+		}
+		s.connectErr = err
+		events <- connectFailed
+		return
+	}
+	// Closing the body aborts the stream, request body included, so it
+	// waits until Handle is done with the tunnel: the backend finishing
+	// first must leave the client's direction open.
+	go func() {
+		<-ctx.Done()
+		res.Body.Close()
+	}()
+	s.backend.Store(backend)
+	var body io.Reader = res.Body
+	if p.TargetTLS != nil {
+		tc, err := p.targetHandshake(ctx, s, res.Body, pw)
+		if err != nil {
+			cl.info.Printf("TLS handshake with target %s failed: %v", s.target, err)
+			p.Metrics.connectionError("target_tls")
+			s.connectErr = err
+			events <- connectFailed
+			return
+		}
+		body = tc
+		go p.copyToTarget(s, tc, pw)
+	}
+	if s.reply != nil && s.reply(nil) != nil {
+		events <- clientError
+		return
+	}
+	s.setState(stateCopying)
+
+	src := io.TeeReader(body, &WriteCounter{
+		Total:      &p.Metrics.backendToClient,
+		Session:    &s.backendBytes,
+		LastActive: &s.lastActive,
+	})
+	var dst io.Writer = conn
+	if p.WriteTimeout > 0 {
+		dst = &deadlineWriter{conn: conn, timeout: p.WriteTimeout}
+	}
+	ew := &errWriter{w: dst}
+	_, err = p.copyBuffer(ew, src)
+	if err != nil && ctx.Err() != nil {
+		// Handle has already given up on the tunnel for its own reasons.
+		cl.debug.Printf("Stopped copying to client: %v", err)
+		events <- backendError
+		return
+	}
+	if err != nil {
+		class := classifyCopyError(err, ew.err != nil)
+		if class == errTimeout && ew.err != nil && p.WriteTimeout > 0 {
+			cl.info.Printf("Closing slow client %v: write blocked for %v", conn.RemoteAddr().String(), p.WriteTimeout)
+			p.Metrics.connectionError("slow_client")
+			events <- slowClient
+			return
+		}
+		cl.info.Printf("%s: %v", copyErrorMessages[class], err)
+		p.Metrics.connectionError(class)
+		events <- backendError
+		return
+	}
+	events <- backendEOF
+}
+
+// readClientHeader reads the PROXY header at the start of r, which reads
+// from conn, into s. It reports whether the client may go on; if not, the
+// reason has been logged.
+func (p *Proxy) readClientHeader(s *session, conn net.Conn, r *bufio.Reader) bool {
+	cl := s.log
+	timeout := optionalHeaderTimeout
+	if p.RequireProxyHeader {
+		timeout = proxyHeaderTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	addr, err := readProxyHeader(r)
+	conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, errNoProxyHeader) && !p.RequireProxyHeader {
+		cl.debug.Printf("No PROXY header; passing on the client's own address")
+	} else if err != nil {
+		cl.info.Printf("Rejecting client: %v", err)
+		return false
+	}
+	if addr != nil {
+		cl.info.Printf("Client is proxied for %v", addr)
+	}
+	s.headerRead, s.clientAddr = true, addr
+	return true
+}
+
+func (p *Proxy) copyClient(s *session, pw *io.PipeWriter, events chan<- copyEvent) {
+	conn, cl := s.conn, s.log
+	r := s.client
+	if p.AcceptProxyProtocol && !s.headerRead {
+		br := bufio.NewReader(r)
+		if !p.readClientHeader(s, conn, br) {
+			events <- clientError
+			return
+		}
+		r = br
+	}
+	clientAddr := s.clientAddr
+
+	if p.Header != nil {
+		localIP := p.LocalIP
+		if localIP == nil {
+			var err error
+			if localIP, err = p.localIP(s.backends[0]); err != nil {
+				cl.debug.Printf("Unable to determine local IP: %v", err)
+			}
+		}
+		remotePort, ok := getRemotePort(conn.RemoteAddr())
+		if !ok && clientAddr == nil {
+			cl.debug.Printf("Not sending PROXY header for %s client", conn.RemoteAddr().Network())
+		}
+		if localIP != nil && (ok || clientAddr != nil) {
+			src := &net.TCPAddr{IP: localIP, Port: remotePort}
+			if clientAddr != nil {
+				src = clientAddr
+			}
+			dst := &net.TCPAddr{IP: localIP, Port: s.targetPort}
+			if p.HeaderTargetPort != 0 {
+				dst.Port = p.HeaderTargetPort
+			}
+			header, err := p.Header(src, dst)
+			if err != nil {
+				cl.info.Printf("Unable to build PROXY header: %v", err)
+				events <- clientError
+				return
+			}
+			if _, err := pw.Write(header); err != nil {
+				events <- clientError
+				return
+			}
+		}
+	}
+
+	src := io.TeeReader(r, &WriteCounter{
+		Total:      &p.Metrics.clientToBackend,
+		Session:    &s.clientBytes,
+		LastActive: &s.lastActive,
+	})
+
+	if _, err := p.copyBuffer(pw, src); err != nil {
+		// Errors from Handle closing the connection or the pipe are not
+		// the client's doing.
+		if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+			class := classifyCopyError(err, true)
+			cl.info.Printf("%s: %v", copyErrorMessages[class], err)
+			p.Metrics.connectionError(class)
+		}
+		events <- clientError
+		return
+	}
+	events <- clientEOF
+}
+
+// handshakeDeadline is when a client must have finished its handshake:
+// after handshakeTimeout, or IdleTimeout or MaxConnLifetime if shorter.
+func (p *Proxy) handshakeDeadline() time.Time {
+	d := handshakeTimeout
+	if p.IdleTimeout > 0 && p.IdleTimeout < d {
+		d = p.IdleTimeout
+	}
+	if p.MaxConnLifetime > 0 && p.MaxConnLifetime < d {
+		d = p.MaxConnLifetime
+	}
+	return time.Now().Add(d)
+}
+
+// Handle tunnels conn to the target. A clean EOF in one direction is
+// propagated as a half-close and the connection is closed once both
+// directions have finished or either fails. Without Backends, conn is
+// closed straight away.
+func (p *Proxy) Handle(conn net.Conn) {
+	p.init()
+	if len(p.Backends) == 0 {
+		p.Log.Printf("Closing connection from %v: %v", conn.RemoteAddr(), ErrNoBackends)
+		conn.Close()
+		return
+	}
+	cl := p.newConnLog(conn)
+	cl.routine.Printf("Client connected: %v\n", conn.RemoteAddr().String())
+	defer cl.routine.Printf("Client disconnected: %v\n", conn.RemoteAddr().String())
+
+	atomic.AddInt64(&p.Metrics.connections, 1)
+	atomic.AddInt64(&p.Metrics.activeConnections, 1)
+	defer atomic.AddInt64(&p.Metrics.activeConnections, -1)
+
+	// Each copy goroutine sends exactly one event, so with room for both
+	// neither blocks once Handle has stopped reading.
+	events := make(chan copyEvent, 2)
+
+	// Cancelling ctx aborts a RoundTrip that is still waiting on the
+	// backend once the client has gone away or shutdown gives up.
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+
+	s := &session{
+		started:    time.Now(),
+		conn:       conn,
+		log:        cl,
+		backends:   p.pickBackends(),
+		lastActive: time.Now().UnixNano(),
+		client:     conn,
+		target:     p.Target,
+		targetPort: p.targetPort,
+	}
+	if r := p.targetRule(conn); r != nil {
+		s.setTarget(r.Target)
+	}
+	p.registry.add(s)
+	defer p.registry.remove(s)
+	tc, isTLS := conn.(*tls.Conn)
+	if isTLS && p.AcceptProxyProtocol {
+		// The PROXY header is sent in the clear ahead of the ClientHello,
+		// so it is read from the raw conn under the TLS one.
+		hc, ok := tc.NetConn().(*headerConn)
+		if !ok {
+			cl.info.Printf("Rejecting client: PROXY header cannot be read from under TLS without HeaderListener")
+			conn.Close()
+			return
+		}
+		if !p.readClientHeader(s, hc.Conn, hc.r) {
+			conn.Close()
+			return
+		}
+	}
+	// A client that never finishes its handshake would otherwise hold its
+	// goroutine and its MaxConnections slot indefinitely.
+	frontend := isTLS || p.SOCKS5 || p.HTTPConnect
+	if frontend {
+		conn.SetDeadline(p.handshakeDeadline())
+	}
+	if isTLS {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			cl.info.Printf("TLS handshake with client failed: %v", err)
+			conn.Close()
+			return
+		}
+		if p.SNITargets != nil {
+			name := tc.ConnectionState().ServerName
+			if target, ok := p.SNITargets[strings.ToLower(name)]; ok {
+				s.setTarget(target)
+			} else if p.RejectUnknownSNI {
+				cl.info.Printf("Rejecting client: no target for server name %q", name)
+				conn.Close()
+				return
+			}
+		}
+	}
+	if (p.SOCKS5 && !p.socksAccept(s)) || (p.HTTPConnect && !p.httpConnectAccept(s)) {
+		conn.Close()
+		return
+	}
+	if frontend {
+		conn.SetDeadline(time.Time{})
+	}
+
+	s.setState(stateConnecting)
+	// The pipe holds no data of its own: each chunk read from the client
+	// is handed straight to the transport, which writes and flushes it as
+	// a DATA frame before the next read, so small writes are not delayed.
+	pr, pw := io.Pipe()
+	// With TargetTLS the client's bytes go through a second pipe, to be
+	// encrypted onto the first once copyProxy has done the handshake.
+	cw := pw
+	if p.TargetTLS != nil {
+		s.plain, cw = io.Pipe()
+	}
+
+	go p.copyProxy(ctx, s, pr, pw, events)
+	go p.copyClient(s, cw, events)
+
+	var idle <-chan struct{}
+	if p.IdleTimeout > 0 {
+		idle = s.watchIdle(ctx, p.IdleTimeout)
+	}
+	var expired <-chan time.Time
+	if p.MaxConnLifetime > 0 {
+		t := time.NewTimer(p.MaxConnLifetime)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	var reason string
+	var failed bool
+	// How each direction ended, if Handle saw it end before closing.
+	clientEnd, backendEnd := "open", "open"
+loop:
+	for pending := 2; pending > 0; pending-- {
+		var ev copyEvent
+		select {
+		case ev = <-events:
+		case <-idle:
+			cl.info.Printf("Closing idle connection: no traffic for %v", p.IdleTimeout)
+			reason = "idle timeout"
+			break loop
+		case <-expired:
+			cl.info.Printf("Closing connection: reached maximum lifetime of %v", p.MaxConnLifetime)
+			reason = "max lifetime"
+			cancel()
+			p.reset(conn)
+			break loop
+		}
+		if reason == "" || ev.failed() {
+			reason, failed = ev.String(), ev.failed()
+		}
+		if ev.fromClient() {
+			clientEnd = ev.end()
+			cl.debug.Printf("Client to backend: %d bytes, then %s", atomic.LoadInt64(&s.clientBytes), clientEnd)
+		} else {
+			backendEnd = ev.end()
+			cl.debug.Printf("Backend to client: %d bytes, then %s", atomic.LoadInt64(&s.backendBytes), backendEnd)
+		}
+		switch ev {
+		case clientEOF:
+			cw.Close()
+		case backendEOF:
+			if closeWrite(conn) != nil {
+				break loop
+			}
+		case clientError:
+			break loop
+		case backendError, slowClient:
+			p.reset(conn)
+			break loop
+		case connectFailed:
+			if !s.refuse(s.connectErr) {
+				p.reset(conn)
+			}
+			break loop
+		}
+	}
+	s.setState(stateClosing)
+	conn.Close()
+	cw.Close()
+	pw.Close()
+
+	if p.AccessLog {
+		if p.ctx.Err() != nil && failed {
+			reason = "shutdown"
+		}
+		s.logClose(reason, clientEnd, backendEnd, time.Since(s.started))
+	}
+}
+
+// Maximum delay between retries of a failing Accept.
+const maxAcceptDelay = time.Second
+
+// Serve accepts connections on ln and handles each in its own goroutine.
+// It returns nil once Shutdown has been called. Accept errors other than
+// the listener being closed, such as running out of file descriptors, are
+// logged and retried with a growing delay. Without Backends, it returns
+// ErrNoBackends straight away.
+func (p *Proxy) Serve(ln net.Listener) error {
+	p.init()
+	if len(p.Backends) == 0 {
+		return ErrNoBackends
+	}
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+
+	if p.HealthInterval > 0 {
+		go p.checkBackends()
+	}
+	if p.limiter != nil {
+		go p.limiter.evict(p.closing)
+	}
+	if p.StatsInterval > 0 {
+		go p.Metrics.logStats(p.Log, p.StatsInterval, p.closing)
+	}
+
+	var acceptDelay time.Duration
+	for {
+		if p.slots != nil && !p.RejectOverflow {
+			select {
+			case p.slots <- struct{}{}:
+			case <-p.closing:
+				return nil
+			}
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-p.closing:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if !p.RejectOverflow {
+				p.releaseSlot()
+			}
+			if acceptDelay == 0 {
+				acceptDelay = 5 * time.Millisecond
+			} else if acceptDelay *= 2; acceptDelay > maxAcceptDelay {
+				acceptDelay = maxAcceptDelay
+			}
+			p.Log.Printf("Accept error: %v; retrying in %v", err, acceptDelay)
+			select {
+			case <-time.After(acceptDelay):
+			case <-p.closing:
+				return nil
+			}
+			continue
+		}
+		acceptDelay = 0
+		if p.refusing(conn) || !p.allowed(conn) || p.rateLimited(conn) {
+			conn.Close()
+			if !p.RejectOverflow {
+				p.releaseSlot()
+			}
+			continue
+		}
+		if p.slots != nil && p.RejectOverflow {
+			select {
+			case p.slots <- struct{}{}:
+			default:
+				p.Log.Printf("Rejecting client %v: %d connections already active", conn.RemoteAddr().String(), p.MaxConnections)
+				atomic.AddInt64(&p.Metrics.rejectedConnections, 1)
+				conn.Close()
+				continue
+			}
+		}
+		if p.slots != nil {
+			atomic.StoreInt64(&p.Metrics.slotsInUse, int64(len(p.slots)))
+		}
+		p.tracker.add(conn)
+		go func() {
+			defer p.tracker.done(conn)
+			defer p.releaseSlot()
+			p.Handle(conn)
+		}()
+	}
+}
+
+func (p *Proxy) releaseSlot() {
+	if p.slots == nil {
+		return
+	}
+	<-p.slots
+	atomic.StoreInt64(&p.Metrics.slotsInUse, int64(len(p.slots)))
+}
+
+// Shutdown stops accepting connections and waits up to timeout for active
+// ones to finish before force-closing the rest.
+func (p *Proxy) Shutdown(timeout time.Duration) (drained, forced int) {
+	p.init()
+	p.mu.Lock()
+	select {
+	case <-p.closing:
+	default:
+		close(p.closing)
+	}
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	p.mu.Unlock()
+
+	active := p.tracker.active()
+	p.Log.Printf("Draining %d connections (timeout %v)", active, timeout)
+	forced = p.tracker.drain(timeout, p.cancel, p.reset)
+	return active - forced, forced
+}
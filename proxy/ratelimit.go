@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdle is how long a source IP's limiter is kept after its last
+// connection. By then its bucket has long since refilled.
+const limiterIdle = 3 * time.Minute
+
+type sourceLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// connLimiter rate limits new connections per source IP with a token
+// bucket for each address.
+type connLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	sources map[string]*sourceLimiter
+}
+
+func newConnLimiter(r float64, burst int) *connLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &connLimiter{limit: rate.Limit(r), burst: burst, sources: map[string]*sourceLimiter{}}
+}
+
+func (l *connLimiter) allow(ip net.IP) bool {
+	key := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sources[key]
+	if !ok {
+		s = &sourceLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.sources[key] = s
+	}
+	s.lastSeen = time.Now()
+	return s.limiter.Allow()
+}
+
+// evict periodically forgets source IPs that have been quiet for
+// limiterIdle, until done is closed.
+func (l *connLimiter) evict(done <-chan struct{}) {
+	ticker := time.NewTicker(limiterIdle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		l.mu.Lock()
+		for key, s := range l.sources {
+			if time.Since(s.lastSeen) > limiterIdle {
+				delete(l.sources, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimited reports whether conn exceeds its source IP's connection
+// rate and should be closed.
+func (p *Proxy) rateLimited(conn net.Conn) bool {
+	ip := clientIP(conn.RemoteAddr())
+	if p.limiter == nil || ip == nil || p.limiter.allow(ip) {
+		return false
+	}
+	p.Log.Printf("Rejecting client %v: more than %v connections per second from %v", conn.RemoteAddr().String(), p.ConnRate, ip)
+	return true
+}
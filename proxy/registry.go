@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type sessionState int32
+
+const (
+	stateHandshake sessionState = iota
+	stateConnecting
+	stateCopying
+	stateClosing
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case stateHandshake:
+		return "handshake"
+	case stateConnecting:
+		return "connecting"
+	case stateCopying:
+		return "copying"
+	case stateClosing:
+		return "closing"
+	}
+	return "unknown"
+}
+
+func (s *session) setState(state sessionState) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
+// registry records the sessions being handled, for the connections
+// endpoint.
+type registry struct {
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+func newRegistry() *registry {
+	return &registry{sessions: make(map[*session]struct{})}
+}
+
+func (r *registry) add(s *session) {
+	r.mu.Lock()
+	r.sessions[s] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *registry) remove(s *session) {
+	r.mu.Lock()
+	delete(r.sessions, s)
+	r.mu.Unlock()
+}
+
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Target     string    `json:"target,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	State      string    `json:"state"`
+	Started    time.Time `json:"started"`
+	Age        string    `json:"age"`
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	infos := []sessionInfo{}
+	r.mu.Lock()
+	for s := range r.sessions {
+		state := sessionState(atomic.LoadInt32(&s.state))
+		info := sessionInfo{
+			ID:         s.log.id,
+			RemoteAddr: s.conn.RemoteAddr().String(),
+			State:      state.String(),
+			Started:    s.started,
+			Age:        now.Sub(s.started).Round(time.Millisecond).String(),
+		}
+		// A frontend handshake may still be changing the target.
+		if state != stateHandshake {
+			info.Target = s.target
+		}
+		if b, ok := s.backend.Load().(*url.URL); ok {
+			info.Backend = b.String()
+		}
+		infos = append(infos, info)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// ConnectionsHandler returns a handler that lists the connections being
+// handled as JSON, oldest first, with the state each one is in.
+func (p *Proxy) ConnectionsHandler() http.Handler {
+	p.init()
+	return p.registry
+}
@@ -0,0 +1,453 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var errAttemptAbandoned = errors.New("proxy: CONNECT attempt abandoned")
+
+// statusError is returned by connect when the backend answers the CONNECT
+// with something other than 200.
+type statusError struct {
+	code   int
+	status string
+	body   []byte
+}
+
+// maxErrorBody bounds how much of a non-200 response body is kept for
+// logging.
+const maxErrorBody = 512
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("backend returned %s", e.status)
+}
+
+// refusedStream reports whether err says the backend turned the stream
+// down with REFUSED_STREAM, meaning it was not processed. When the request
+// has a body the transport declines to retry these itself and returns a
+// plain error that only mentions the code in its text. It does retry a
+// stream that found its connection over the backend's limit, but only
+// after closing the body, and that retry fails with errAttemptAbandoned.
+func refusedStream(err error) bool {
+	if errors.Is(err, errAttemptAbandoned) {
+		return true
+	}
+	var se http2.StreamError
+	if errors.As(err, &se) {
+		return se.Code == http2.ErrCodeRefusedStream
+	}
+	return strings.Contains(err.Error(), "REFUSED_STREAM")
+}
+
+// goAway reports whether err says the backend connection was shut down
+// with GOAWAY, and if so whether the stream is known not to have been
+// processed: a stream above the GOAWAY's last stream ID fails with the
+// transport's "graceful shutdown" error, flattened into text when the
+// request has a body, while one at or below it gets a GoAwayError.
+func goAway(err error) (ok, unprocessed bool) {
+	var ge http2.GoAwayError
+	if errors.As(err, &ge) {
+		return true, false
+	}
+	if strings.Contains(err.Error(), "graceful shutdown GOAWAY") {
+		return true, true
+	}
+	return false, false
+}
+
+// freshRetry reports whether a CONNECT that failed with err should be
+// sent again straight away on another connection, rewinding cb if the
+// backend is known not to have seen the bytes given to it, and why.
+func (p *Proxy) freshRetry(err error, cb *connectBody) (string, bool) {
+	if p.RetryRefused && refusedStream(err) {
+		return "Backend refused the stream", cb.rewind()
+	}
+	if ok, unprocessed := goAway(err); ok && p.RetryGoAway {
+		if unprocessed {
+			return "Backend connection is going away", cb.rewind()
+		}
+		// The backend may have acted on the request, so only retry if
+		// no client bytes could have reached the target.
+		return "Backend connection went away", !cb.hasSent()
+	}
+	return "", false
+}
+
+func (e *statusError) retryable() bool {
+	switch e.code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// connectBody shares the client side of the tunnel between successive
+// CONNECT attempts. A single goroutine reads from the client so that an
+// abandoned attempt can be unblocked without closing the pipe; a chunk it
+// receives after being abandoned is held back for the next attempt. sent
+// records whether any bytes were handed to an attempt. Up to maxReplay
+// bytes handed to the current attempt are kept in replay so that rewind
+// can give them to the next one. Once an attempt is committed the
+// goroutine stops after its current read, and the attempt reads from the
+// client directly.
+type connectBody struct {
+	r      io.Reader
+	size   int
+	ctx    context.Context
+	chunks chan []byte
+	err    error
+
+	mu        sync.Mutex
+	attempt   int
+	closed    chan struct{}
+	pending   []byte
+	sent      bool
+	replay    []byte
+	replayOK  bool
+	pumping   bool
+	committed bool
+	direct    bool
+}
+
+// maxReplay bounds how much client data is kept for rewind.
+const maxReplay = 64 << 10
+
+func newConnectBody(ctx context.Context, r io.Reader, size int) *connectBody {
+	return &connectBody{r: r, size: size, ctx: ctx, chunks: make(chan []byte)}
+}
+
+func (b *connectBody) pump() {
+	defer close(b.chunks)
+	for {
+		b.mu.Lock()
+		committed := b.committed
+		b.mu.Unlock()
+		if committed {
+			return
+		}
+		buf := make([]byte, b.size)
+		n, err := b.r.Read(buf)
+		if n > 0 {
+			select {
+			case b.chunks <- buf[:n]:
+			case <-b.ctx.Done():
+				b.err = b.ctx.Err()
+				return
+			}
+		}
+		if err != nil {
+			b.err = err
+			return
+		}
+	}
+}
+
+func (b *connectBody) next() io.ReadCloser {
+	b.abandon()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = make(chan struct{})
+	b.replay, b.replayOK = nil, true
+	return &attemptBody{b: b, attempt: b.attempt, closed: b.closed}
+}
+
+// abandon stops the current attempt from reading any further.
+func (b *connectBody) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	b.attempt++
+}
+
+// rewind puts the bytes handed to the abandoned attempt back in front of
+// the pending ones, and reports whether it could. It is only safe if the
+// backend is known not to have processed them.
+func (b *connectBody) rewind() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.replayOK {
+		return false
+	}
+	b.pending = append(b.replay, b.pending...)
+	b.replay = nil
+	b.sent = false
+	return true
+}
+
+// commit stops keeping data for rewind once an attempt has succeeded.
+func (b *connectBody) commit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replay, b.replayOK = nil, false
+	b.committed = true
+	b.direct = !b.pumping
+}
+
+// record keeps p for rewind. b.mu must be held.
+func (b *connectBody) record(p []byte) {
+	if !b.replayOK {
+		return
+	}
+	if len(b.replay)+len(p) > maxReplay {
+		b.replay, b.replayOK = nil, false
+		return
+	}
+	b.replay = append(b.replay, p...)
+}
+
+func (b *connectBody) hasSent() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sent
+}
+
+type attemptBody struct {
+	b       *connectBody
+	attempt int
+	closed  chan struct{}
+}
+
+func (a *attemptBody) Read(p []byte) (int, error) {
+	b := a.b
+	b.mu.Lock()
+	if a.attempt != b.attempt {
+		b.mu.Unlock()
+		return 0, errAttemptAbandoned
+	}
+	if len(b.pending) > 0 {
+		n := copy(p, b.pending)
+		b.pending = b.pending[n:]
+		b.sent = true
+		b.record(p[:n])
+		b.mu.Unlock()
+		return n, nil
+	}
+	if b.direct {
+		b.mu.Unlock()
+		return b.r.Read(p)
+	}
+	if !b.pumping {
+		b.pumping = true
+		go b.pump()
+	}
+	b.mu.Unlock()
+
+	select {
+	case chunk, ok := <-b.chunks:
+		b.mu.Lock()
+		if a.attempt != b.attempt {
+			b.pending = append(b.pending, chunk...)
+			b.mu.Unlock()
+			return 0, errAttemptAbandoned
+		}
+		if !ok && b.err == nil {
+			// The pump stopped on commit, handing the client over.
+			b.direct = true
+			b.mu.Unlock()
+			return b.r.Read(p)
+		}
+		defer b.mu.Unlock()
+		if !ok {
+			return 0, b.err
+		}
+		n := copy(p, chunk)
+		b.pending = append(b.pending, chunk[n:]...)
+		b.sent = true
+		b.record(p[:n])
+		return n, nil
+	case <-a.closed:
+		return 0, errAttemptAbandoned
+	}
+}
+
+// Close abandons the attempt but leaves the client pipe open for a retry;
+// Handle closes the pipe once the tunnel is done.
+func (a *attemptBody) Close() error {
+	b := a.b
+	b.mu.Lock()
+	current := a.attempt == b.attempt
+	b.mu.Unlock()
+	if current {
+		b.abandon()
+	}
+	return nil
+}
+
+func (p *Proxy) requestHeader() http.Header {
+	if p.BearerToken == nil {
+		return p.RequestHeader
+	}
+	token := p.BearerToken()
+	if token == "" {
+		return p.RequestHeader
+	}
+	h := p.RequestHeader.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Authorization", "Bearer "+token)
+	return h
+}
+
+// connectHeader is requestHeader plus the ForwardedHeader naming the
+// client of s.
+func (p *Proxy) connectHeader(s *session) http.Header {
+	h := p.requestHeader()
+	if p.ForwardedHeader == "" {
+		return h
+	}
+	value, ok := forwardedFor(p.ForwardedHeader, s.conn.RemoteAddr())
+	if !ok {
+		return h
+	}
+	h = h.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set(p.ForwardedHeader, value)
+	return h
+}
+
+// forwardedFor returns the value of header, X-Forwarded-For or Forwarded,
+// for a client at addr. X-Forwarded-For carries the bare IP. Forwarded
+// follows RFC 7239, which has IPv6 addresses bracketed and quoted, and
+// clients with no IP address are "unknown".
+func forwardedFor(header string, addr net.Addr) (string, bool) {
+	ip := clientIP(addr)
+	if header == "X-Forwarded-For" {
+		return ip.String(), ip != nil
+	}
+	switch {
+	case ip == nil:
+		return "for=unknown", true
+	case ip.To4() == nil:
+		return fmt.Sprintf("for=\"[%s]\"", ip), true
+	}
+	return "for=" + ip.String(), true
+}
+
+// connect sends the CONNECT request for s to each of its backends in turn, retrying
+// each up to ConnectRetries times with exponential backoff, for as long as
+// no client bytes have been sent to a backend. It returns the response
+// along with the backend that sent it. A non-200 response is returned as
+// a *statusError.
+func (p *Proxy) connect(ctx context.Context, s *session, body io.ReadCloser) (*http.Response, *url.URL, error) {
+	cl, backends := s.log, s.backends
+	var cb *connectBody
+	if p.ConnectRetries > 0 || len(backends) > 1 || p.RetryRefused || p.RetryGoAway {
+		cb = newConnectBody(ctx, body, p.BufferSize)
+	}
+
+	var err error
+	for i, backend := range backends {
+		if i > 0 {
+			cl.info.Printf("Falling back to backend %v: %v", backend, err)
+		}
+		var res *http.Response
+		res, err = p.connectBackend(ctx, s, backend, cb, body)
+		if err == nil {
+			return res, backend, nil
+		}
+		var serr *statusError
+		if (errors.As(err, &serr) && !serr.retryable()) || cb == nil || cb.hasSent() || ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+func (p *Proxy) connectBackend(ctx context.Context, s *session, backend *url.URL, cb *connectBody, body io.ReadCloser) (*http.Response, error) {
+	cl := s.log
+	delay := p.ConnectRetryDelay
+	retriedFresh := false
+	for attempt := 0; ; attempt++ {
+		// The request's context lives on as the tunnel's, so the timeout
+		// cancels it only if it fires before the response arrives.
+		rctx, cancel := withTarget(ctx, s.target), context.CancelFunc(func() {})
+		var timer *time.Timer
+		if p.ConnectTimeout > 0 {
+			rctx, cancel = context.WithCancel(rctx)
+			timer = time.AfterFunc(p.ConnectTimeout, cancel)
+		}
+		req := (&http.Request{
+			Method: "CONNECT",
+			URL:    backend,
+			Host:   s.target,
+			Header: p.connectHeader(s),
+			Body:   body,
+		}).WithContext(rctx)
+		if cb != nil {
+			req.Body = cb.next()
+		}
+
+		// Send the request
+		//res, err := c.Do(req)
+		res, err := p.Transport.RoundTrip(req)
+		if timer != nil && !timer.Stop() && ctx.Err() == nil {
+			if res != nil {
+				res.Body.Close()
+				res = nil
+			}
+			err = fmt.Errorf("%w after %v", errConnectTimeout, p.ConnectTimeout)
+		}
+		retryable := false
+		if err != nil {
+			cl.info.Printf("Error in tr.RoundTrip: %v", err)
+			retryable = true
+		} else if res.StatusCode != 200 {
+			limit := int64(maxErrorBody)
+			if p.MaxHeaderBytes > 0 && int64(p.MaxHeaderBytes) < limit {
+				limit = int64(p.MaxHeaderBytes)
+			}
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, limit))
+			res.Body.Close()
+			serr := &statusError{code: res.StatusCode, status: res.Status, body: body}
+			err = serr
+			retryable = serr.retryable()
+		} else {
+			if cb != nil {
+				cb.commit()
+			}
+			return res, nil
+		}
+
+		cancel()
+		if cb != nil {
+			cb.abandon()
+		}
+		if !retriedFresh && res == nil && ctx.Err() == nil && cb != nil {
+			if why, ok := p.freshRetry(err, cb); ok {
+				// This does not count as an attempt.
+				cl.info.Printf("%s, retrying on another connection", why)
+				retriedFresh = true
+				attempt--
+				continue
+			}
+		}
+		if cb == nil || attempt >= p.ConnectRetries || !retryable || cb.hasSent() || ctx.Err() != nil {
+			return nil, err
+		}
+		cl.info.Printf("Retrying CONNECT in %v (attempt %d of %d): %v", delay, attempt+1, p.ConnectRetries, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
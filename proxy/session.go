@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// session is the state of a single proxied client connection.
+type session struct {
+	// Accessed atomically; first to keep them 64-bit aligned.
+	lastActive   int64
+	clientBytes  int64
+	backendBytes int64
+	state        int32 // a sessionState
+
+	started  time.Time
+	conn     net.Conn
+	client   io.Reader // reads from conn, past any frontend handshake
+	log      connLog
+	backends []*url.URL
+	backend  atomic.Value // *url.URL once the CONNECT succeeds
+
+	// target is the authority sent in the CONNECT request and targetPort
+	// its port, for the PROXY header.
+	target     string
+	targetPort int
+
+	// headerRead is set once the client's PROXY header has been read, and
+	// clientAddr is the source address it named, if any.
+	headerRead bool
+	clientAddr *net.TCPAddr
+
+	// plain carries the client's bytes to copyToTarget, with TargetTLS.
+	plain *io.PipeReader
+
+	// reply, if set, tells the client how the CONNECT went, for frontends
+	// that wait on the backend before answering their handshake.
+	reply func(err error) error
+	// connectErr is why the CONNECT failed, set before connectFailed is
+	// sent.
+	connectErr error
+}
+
+// setTarget points s at target, a host:port.
+func (s *session) setTarget(target string) {
+	s.target = target
+	_, port, _ := net.SplitHostPort(target)
+	s.targetPort, _ = strconv.Atoi(port)
+}
+
+// refuse tells the client that the tunnel could not be established, and
+// reports whether it could. Frontends with a handshake of their own are
+// sent a reply saying why and should then be closed normally, so that the
+// reply is not lost; raw TCP clients have no way to be told and should be
+// reset instead.
+func (s *session) refuse(err error) bool {
+	return s.reply != nil && s.reply(err) == nil
+}
+
+// logClose writes the access log line for the session. clientEnd and
+// backendEnd say how the client to backend and backend to client
+// directions ended: EOF, error or the like, or open if the tunnel was
+// closed first.
+func (s *session) logClose(reason, clientEnd, backendEnd string, d time.Duration) {
+	backend := "none"
+	if b, ok := s.backend.Load().(*url.URL); ok {
+		backend = b.String()
+	}
+	sent := atomic.LoadInt64(&s.clientBytes)
+	received := atomic.LoadInt64(&s.backendBytes)
+	if l := withFields(s.log.info,
+		"backend", backend,
+		"bytes_client_to_backend", strconv.FormatInt(sent, 10),
+		"bytes_backend_to_client", strconv.FormatInt(received, 10),
+		"client_to_backend_end", clientEnd,
+		"backend_to_client_end", backendEnd,
+		"duration", d.String(),
+		"reason", reason,
+	); l != s.log.info {
+		l.Print("Connection closed")
+		return
+	}
+	s.log.info.Printf("Connection closed: backend=%s bytes_client_to_backend=%d bytes_backend_to_client=%d client_to_backend_end=%q backend_to_client_end=%q duration=%v reason=%q",
+		backend, sent, received, clientEnd, backendEnd, d, reason)
+}
+
+// watchIdle returns a channel that is closed once no data has flowed for
+// timeout. It stops watching when ctx is done.
+func (s *session) watchIdle(ctx context.Context, timeout time.Duration) <-chan struct{} {
+	idle := make(chan struct{})
+	go func() {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+			if since >= timeout {
+				close(idle)
+				return
+			}
+			t.Reset(timeout - since)
+		}
+	}()
+	return idle
+}
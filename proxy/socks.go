@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// SOCKS5 reply codes, from RFC 1928 section 6.
+const (
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+)
+
+// socksError is a failed SOCKS5 request, carrying the reply code to send.
+type socksError struct {
+	code byte
+	err  error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+// socksHandshake performs the SOCKS5 method negotiation and reads a
+// CONNECT request from conn, returning the requested host:port. Only the
+// no-authentication method and the CONNECT command are supported. The
+// reply is left to the caller, once the outcome of the tunnel is known.
+func socksHandshake(conn net.Conn) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != 0x05 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(0xFF)
+	for _, m := range methods {
+		if m == 0x00 {
+			method = 0x00
+		}
+	}
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return "", err
+	}
+	if method == 0xFF {
+		return "", errors.New("no acceptable SOCKS authentication method")
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[0] != 0x05 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 0x04:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", &socksError{socksAddrNotSupported, fmt.Errorf("unsupported SOCKS address type %d", req[3])}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	if req[1] != 0x01 {
+		return "", &socksError{socksCommandNotSupported, fmt.Errorf("unsupported SOCKS command %d", req[1])}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply sends a SOCKS5 reply with the given code. The bound address
+// is not meaningful for a tunnel, so it is always 0.0.0.0:0.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{0x05, code, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksCode maps a failed CONNECT to the SOCKS5 reply code for it.
+func socksCode(err error) byte {
+	var serr *statusError
+	if !errors.As(err, &serr) {
+		return socksNetworkUnreachable
+	}
+	switch serr.code {
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusUnauthorized:
+		return socksNotAllowed
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// socksAccept runs the SOCKS5 handshake for s and points it at the
+// requested destination. On failure the client is sent a reply, where the
+// protocol allows one, and false is returned.
+func (p *Proxy) socksAccept(s *session) bool {
+	target, err := socksHandshake(s.conn)
+	if err != nil {
+		s.log.info.Printf("SOCKS5 handshake failed: %v", err)
+		var serr *socksError
+		if errors.As(err, &serr) {
+			socksReply(s.conn, serr.code)
+		}
+		return false
+	}
+	s.log.info.Printf("SOCKS5 client requested %s", target)
+	s.setTarget(target)
+	s.reply = func(err error) error {
+		if err != nil {
+			return socksReply(s.conn, socksCode(err))
+		}
+		return socksReply(s.conn, socksSucceeded)
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// streamConn is a tunnel's CONNECT stream as a net.Conn, for a TLS
+// session with the target to run over.
+type streamConn struct {
+	r      io.ReadCloser
+	w      *io.PipeWriter
+	target string
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *streamConn) Close() error {
+	c.w.Close()
+	return c.r.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return tunnelAddr("") }
+func (c *streamConn) RemoteAddr() net.Addr { return tunnelAddr(c.target) }
+
+// The stream has no deadlines of its own; its context bounds it instead.
+func (c *streamConn) SetDeadline(time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// targetHandshake starts a TLS session with the target of s over its
+// CONNECT stream, read from body and written to pw, using TargetTLS with
+// the target's host as the default ServerName. ConnectTimeout, if set,
+// also bounds the handshake.
+func (p *Proxy) targetHandshake(ctx context.Context, s *session, body io.ReadCloser, pw *io.PipeWriter) (*tls.Conn, error) {
+	cfg := p.TargetTLS.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(s.target)
+	}
+	if p.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.ConnectTimeout)
+		defer cancel()
+	}
+	tc := tls.Client(&streamConn{r: body, w: pw, target: s.target}, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// copyToTarget encrypts what copyClient reads from the client, taken from
+// s.plain, onto the CONNECT stream. Once the client is done it ends the
+// TLS session's writing side and then the stream's.
+func (p *Proxy) copyToTarget(s *session, tc *tls.Conn, pw *io.PipeWriter) {
+	if _, err := p.copyBuffer(tc, s.plain); err != nil {
+		s.plain.CloseWithError(err)
+		pw.CloseWithError(err)
+		return
+	}
+	tc.CloseWrite()
+	pw.Close()
+}
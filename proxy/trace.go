@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+var traceConnID uint32
+
+// TraceFrames wraps c, an HTTP/2 client connection to addr, so that the
+// control frames passing over it (SETTINGS, PING, WINDOW_UPDATE,
+// RST_STREAM and GOAWAY) are logged to l in both directions, each line
+// tagged with an ID for the connection. DATA and HEADERS are passed over,
+// as the byte counts from WrapConnection already cover them.
+func TraceFrames(c net.Conn, addr string, l *log.Logger) net.Conn {
+	id := atomic.AddUint32(&traceConnID, 1)
+	l.Printf("[h2 %d] Connection to %s", id, addr)
+	return &traceConn{
+		Conn:  c,
+		read:  frameParser{id: id, dir: "received", log: l},
+		write: frameParser{id: id, dir: "sent", log: l, skip: len(http2.ClientPreface)},
+	}
+}
+
+type traceConn struct {
+	net.Conn
+	read, write frameParser
+}
+
+func (tc *traceConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	tc.read.feed(b[:n])
+	return n, err
+}
+
+func (tc *traceConn) Write(b []byte) (int, error) {
+	n, err := tc.Conn.Write(b)
+	tc.write.feed(b[:n])
+	return n, err
+}
+
+func (tc *traceConn) CloseWrite() error {
+	return closeWrite(tc.Conn)
+}
+
+// maxTracePayload bounds how much of a frame is kept for logging; only
+// GOAWAY debug data is ever longer.
+const maxTracePayload = 1024
+
+// frameParser follows the frames in one direction of an HTTP/2
+// connection. feed is only ever called from one goroutine at a time: the
+// transport has a single reader, and serializes its writes.
+type frameParser struct {
+	id   uint32
+	dir  string
+	log  *log.Logger
+	skip int
+
+	hdr     [9]byte
+	hn      int
+	need    int
+	payload []byte
+}
+
+func (p *frameParser) feed(b []byte) {
+	for len(b) > 0 {
+		if p.skip > 0 {
+			n := minInt(p.skip, len(b))
+			p.skip -= n
+			b = b[n:]
+			continue
+		}
+		if p.hn < len(p.hdr) {
+			n := copy(p.hdr[p.hn:], b)
+			p.hn += n
+			b = b[n:]
+			if p.hn == len(p.hdr) {
+				p.need = int(p.hdr[0])<<16 | int(p.hdr[1])<<8 | int(p.hdr[2])
+				p.payload = p.payload[:0]
+				if p.need == 0 {
+					p.frame()
+				}
+			}
+			continue
+		}
+		n := minInt(p.need, len(b))
+		if keep := maxTracePayload - len(p.payload); keep > 0 {
+			p.payload = append(p.payload, b[:minInt(n, keep)]...)
+		}
+		p.need -= n
+		b = b[n:]
+		if p.need == 0 {
+			p.frame()
+		}
+	}
+}
+
+// frame logs the frame that has just been read in full, and gets ready
+// for the next.
+func (p *frameParser) frame() {
+	p.hn = 0
+	typ := http2.FrameType(p.hdr[3])
+	flags := http2.Flags(p.hdr[4])
+	stream := binary.BigEndian.Uint32(p.hdr[5:]) & (1<<31 - 1)
+	b := p.payload
+	var detail string
+	switch typ {
+	case http2.FrameSettings:
+		if flags.Has(http2.FlagSettingsAck) {
+			detail = "ACK"
+			break
+		}
+		var s []string
+		for ; len(b) >= 6; b = b[6:] {
+			s = append(s, fmt.Sprintf("%v=%d", http2.SettingID(binary.BigEndian.Uint16(b)), binary.BigEndian.Uint32(b[2:])))
+		}
+		detail = strings.Join(s, " ")
+	case http2.FramePing:
+		if flags.Has(http2.FlagPingAck) {
+			detail = "ACK"
+		}
+	case http2.FrameWindowUpdate:
+		if len(b) >= 4 {
+			detail = fmt.Sprintf("stream=%d incr=%d", stream, binary.BigEndian.Uint32(b)&(1<<31-1))
+		}
+	case http2.FrameRSTStream:
+		if len(b) >= 4 {
+			detail = fmt.Sprintf("stream=%d code=%v", stream, http2.ErrCode(binary.BigEndian.Uint32(b)))
+		}
+	case http2.FrameGoAway:
+		if len(b) >= 8 {
+			detail = fmt.Sprintf("last_stream=%d code=%v", binary.BigEndian.Uint32(b)&(1<<31-1), http2.ErrCode(binary.BigEndian.Uint32(b[4:])))
+			if len(b) > 8 {
+				detail += fmt.Sprintf(" debug=%q", b[8:])
+			}
+		}
+	default:
+		return
+	}
+	p.log.Printf("[h2 %d] %s", p.id, strings.TrimSpace(fmt.Sprintf("%s %v %s", p.dir, typ, detail)))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type connTracker struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.wg.Add(1)
+	t.mu.Lock()
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *connTracker) done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+func (t *connTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// drain waits up to timeout for tracked connections to finish, then calls
+// expired and force-closes whatever is left, passing each to reset first,
+// returning how many that was.
+func (t *connTracker) drain(timeout time.Duration, expired func(), reset func(net.Conn)) int {
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return 0
+	case <-time.After(timeout):
+	}
+	expired()
+
+	t.mu.Lock()
+	forced := len(t.conns)
+	for conn := range t.conns {
+		reset(conn)
+		conn.Close()
+	}
+	t.mu.Unlock()
+	<-finished
+	return forced
+}
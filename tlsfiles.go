@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+)
+
+// tlsFiles holds the client certificate and CA bundle read from disk so
+// that they can be swapped on SIGHUP. Connections already established keep
+// the material they were dialed with.
+type tlsFiles struct {
+	certFile, keyFile string
+	caFile            string
+	cert              atomic.Value // *tls.Certificate
+	roots             atomic.Value // *x509.CertPool
+}
+
+func (t *tlsFiles) loadCert() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+	t.cert.Store(&cert)
+	return nil
+}
+
+func (t *tlsFiles) loadCA() error {
+	pem, err := ioutil.ReadFile(t.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", t.caFile)
+	}
+	t.roots.Store(pool)
+	return nil
+}
+
+// reload re-reads whichever files are configured, keeping the previous
+// material for any that fail to load.
+func (t *tlsFiles) reload() {
+	if t.certFile != "" {
+		if err := t.loadCert(); err != nil {
+			log.Printf("Unable to reload client certificate, keeping the previous one: %v", err)
+		} else {
+			log.Printf("Reloaded client certificate from %s", t.certFile)
+		}
+	}
+	if t.caFile != "" {
+		if err := t.loadCA(); err != nil {
+			log.Printf("Unable to reload CA bundle, keeping the previous one: %v", err)
+		} else {
+			log.Printf("Reloaded CA bundle from %s", t.caFile)
+		}
+	}
+}
+
+func (t *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return t.cert.Load().(*tls.Certificate), nil
+}
+
+func (t *tlsFiles) rootCAs() *x509.CertPool {
+	return t.roots.Load().(*x509.CertPool)
+}
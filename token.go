@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const tokenRefreshInterval = 30 * time.Second
+
+// tokenFile holds a bearer token read from disk, re-reading it
+// periodically so that rotated tokens are picked up without a restart.
+type tokenFile struct {
+	path  string
+	token atomic.Value
+}
+
+func (t *tokenFile) load() error {
+	b, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return fmt.Errorf("%s is empty", t.path)
+	}
+	t.token.Store(token)
+	return nil
+}
+
+func (t *tokenFile) watch() {
+	for range time.Tick(tokenRefreshInterval) {
+		if err := t.load(); err != nil {
+			log.Printf("Unable to reload bearer token, keeping the previous one: %v", err)
+		}
+	}
+}
+
+func (t *tokenFile) get() string {
+	return t.token.Load().(string)
+}